@@ -18,8 +18,10 @@ package api
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/gorilla/mux"
@@ -27,55 +29,19 @@ import (
 
 // Catalog is executed when /v2/catalog is called via HTTP GET method
 // It returns catalog of available services
-func Catalog(w http.ResponseWriter, r *http.Request) {
-	plans := []Plan{
-		{
-			ID:          "83c8811b-f3db-17ef-6eb3-bbe944b47262",
-			Name:        "5mb",
-			Description: "5 mb of psql database",
-			Metadata:    nil,
-			Free:        true,
-			Bindable:    true,
-		},
-		{
-			ID:          "39292da3-de98-2891-11f0-c36a3264dbb5",
-			Name:        "50mb",
-			Description: "50 mb of psql database",
-			Free:        true,
-			Bindable:    true,
-		},
-	}
-	dashb := DashboardClient{
-		ID:          "test",
-		Secret:      "test",
-		RedirectURI: "http://localhost:9000"}
-
-	data := Service{
-		Name:           "posgreSQL",
-		ID:             "1",
-		Description:    "A postgresql DB service",
-		Tags:           []string{},
-		Requires:       []string{},
-		Bindable:       true,
-		Metadata:       nil,
-		DClient:        dashb,
-		PlanUpdateable: true,
-		Plans:          plans,
-	}
-	catalog := CatalogObject{
-		[]Service{data},
-	}
+func (h *DbHandler) Catalog(w http.ResponseWriter, r *http.Request) {
+	catalog := h.catalog()
 
 	js, err := json.Marshal(catalog)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		respondError(w, NewInternalError(err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(js)
 	if err != nil {
-		log.Print(err)
+		h.requestLogger(r).Warn("writing the response failed", "error", err)
 	}
 }
 
@@ -89,23 +55,16 @@ func Catalog(w http.ResponseWriter, r *http.Request) {
 // parameters -json obj
 // accepts_incomplete - boolean
 func (h *DbHandler) Provision(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
 	var status int
 	var body []byte
 	var err error
-	var werr error
-
-	//Print write errors if any
-	defer func(e *error) {
-		if e != nil {
-			log.Print(e)
-		}
-	}(&werr)
 	//close body if exists
 	defer func() {
 		if r.Body != nil {
 			e := r.Body.Close()
 			if e != nil {
-				log.Print(e.Error())
+				logger.Warn("closing the request body failed", "error", e)
 			}
 		}
 	}()
@@ -115,17 +74,17 @@ func (h *DbHandler) Provision(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(*s)
 		_, err = w.Write(*b)
 		if err != nil {
-			log.Print(err)
+			logger.Warn("writing the response failed", "error", err)
 		}
 	}(&status, &body)
 
 	vars := mux.Vars(r)
 	id := vars["id"]
+	logger = logger.With("instance_id", id)
 
 	// Input validation: check if id is a valid UUID string
 	if IsValidUUID(id) == false {
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, errInvalidInstanceID)
 		return
 	}
 
@@ -135,22 +94,103 @@ func (h *DbHandler) Provision(w http.ResponseWriter, r *http.Request) {
 	var provisionRequest ProvisionRequest
 	err = decoder.Decode(&provisionRequest)
 	if err != nil {
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, NewBadRequestError("Malformed request body: "+err.Error()))
 		return
 	}
 
 	//Input validation, verify that provisionRequest has valid required fields
 	if IsValidProvisionRequest(provisionRequest) == false {
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, NewBadRequestError(
+			"service_id, plan_id, organization_guid and space_guid must be valid UUIDs"))
+		return
+	}
+	logger = logger.With("plan_id", provisionRequest.PlanID)
+	if _, ok := h.findServicePlan(provisionRequest.ServiceID, provisionRequest.PlanID); !ok {
+		writeError(&status, &body, NewBadRequestError("Plan "+provisionRequest.PlanID+
+			" of service "+provisionRequest.ServiceID+" is not offered by the catalog"))
 		return
 	}
 
-	si, err := h.Add(id, provisionRequest)
+	// Platforms send accepts_incomplete as a query param, the body field is
+	// still honored
+	if r.URL.Query().Get("accepts_incomplete") == "true" {
+		provisionRequest.AcceptsIncomplete = true
+	}
+	if h.RequireAsync && !provisionRequest.AcceptsIncomplete {
+		writeError(&status, &body, ErrAsyncRequired)
+		return
+	}
+
+	// Retried requests for an existing instance are answered with the
+	// instance as long as they ask for the same attributes
+	si, err := h.Store.GetInstance(id)
+	existing := err == nil
+	if existing {
+		// Instances whose asynchronous provision failed are not provisioned,
+		// a registration left behind is discarded and provisioned again
+		op, e := h.Store.GetOperation(id, "")
+		if e == nil && op.Type == OperationProvision && op.State == OperationFailed {
+			err = h.Discard(si, logger)
+			if err != nil {
+				logger.Error("provision failed", "error", err)
+				writeError(&status, &body, NewInternalError(err))
+				return
+			}
+			existing = false
+		}
+	}
+	switch {
+	case existing && !si.Matches(provisionRequest):
+		writeError(&status, &body, errInstanceConflict)
+		return
+	case err != nil && err != ErrInstanceNotFound:
+		logger.Error("provision failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	// When the platform accepts asynchronous operations the container is
+	// started in background and the platform polls last_operation
+	var op Operation
+	switch {
+	case existing:
+		// An asynchronous provision still running is reported again
+		op, err = h.Store.GetOperation(id, "")
+		if err == ErrOperationNotFound || op.Type != OperationProvision || op.State != OperationInProgress {
+			op, err = Operation{}, nil
+		}
+	case provisionRequest.AcceptsIncomplete:
+		si, err = h.Register(id, provisionRequest, logger)
+		if err == nil {
+			op, err = h.AddOperation(id, OperationProvision)
+		}
+		if err == nil {
+			h.runOperation(op, logger, func() error {
+				err := h.Start(si)
+				if err != nil {
+					if e := h.Discard(si, logger); e != nil {
+						logger.Error("forgetting the failed instance failed", "error", e)
+					}
+				}
+				return err
+			})
+		}
+	default:
+		si, err = h.Add(id, provisionRequest, logger)
+	}
+	if err == ErrInstanceExists {
+		// A concurrent request registered the instance first
+		writeError(&status, &body, errInstanceConflict)
+		return
+	}
+	if err == ErrNoPortAvailable {
+		logger.Error("provision failed: every port is allocated")
+		writeError(&status, &body, errNoPortAvailable)
+		return
+	}
 	if err != nil {
-		status = http.StatusInternalServerError
-		writeEmptyJSON(&body)
+		logger.Error("provision failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
 		return
 	}
 
@@ -161,23 +201,230 @@ func (h *DbHandler) Provision(w http.ResponseWriter, r *http.Request) {
 	db.Provider = si.Service
 
 	resp := new(ProvisionResponse)
-	resp.DashboardURL = "" + si.ID + ";" + strconv.Itoa(si.Port) + ";" + si.Info
+	resp.DashboardURL = h.dashboardURL(si)
 	resp.Database = *db
+	resp.Operation = op.ID
 	responseBody, err := json.Marshal(resp)
 	if err != nil {
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, NewInternalError(err))
 		return
 	}
 
 	status = http.StatusCreated // set status created for new instance
+	if existing {
+		status = http.StatusOK // instance already provisioned
+	}
+	if op.ID != "" {
+		status = http.StatusAccepted // instance is still being provisioned
+	}
+	logger.Info("provision answered", "status", status, "operation_id", op.ID)
 	body = responseBody
 }
 
+// FetchInstance is executed when the platform reads back a service instance
+// via HTTP GET method
+// vars [id]
+// expected status codes are 200, 404 and 422 according to Service Broker API
+// specification
+func (h *DbHandler) FetchInstance(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	logger = logger.With("instance_id", id)
+
+	// Input validation: check if id is a valid UUID string
+	if IsValidUUID(id) == false {
+		writeError(&status, &body, errInvalidInstanceID)
+		return
+	}
+
+	si, err := h.Store.GetInstance(id)
+	if err == ErrInstanceNotFound {
+		writeError(&status, &body, errNoSuchInstance)
+		return
+	}
+	if err != nil {
+		logger.Error("fetching the instance failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	// Instances still being provisioned do not exist yet for the platform,
+	// instances being updated cannot be fetched until the update ends
+	op, err := h.Store.GetOperation(id, "")
+	switch {
+	case err == ErrOperationNotFound:
+	case err != nil:
+		logger.Error("fetching the instance failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	case op.State == OperationInProgress && op.Type == OperationProvision:
+		writeError(&status, &body, errNoSuchInstance)
+		return
+	case op.State == OperationInProgress && op.Type == OperationUpdate:
+		writeError(&status, &body, ErrConcurrency)
+		return
+	}
+
+	resp := FetchInstanceResponse{
+		ServiceID:     si.ServiceID,
+		PlanID:        si.PlanID,
+		DashboardURL:  h.dashboardURL(si),
+		Parameters:    rawParameters(si.Parameters),
+		QuotaExceeded: si.QuotaExceeded,
+	}
+	if plan, ok := h.findPlan(si.PlanID); ok {
+		resp.QuotaBytes = plan.Limits.StorageMB * bytesPerMB
+	}
+	if usage, err := h.Provisioner.Usage(si); err == nil {
+		resp.UsageBytes = usage.SizeBytes
+	} else {
+		logger.Warn("measuring the instance usage failed", "error", err)
+	}
+
+	status = http.StatusOK
+	body, _ = json.Marshal(resp)
+}
+
+// Update changes the plan of a service instance, the limits of the new plan
+// are applied to the instance's container
+// vars [id]
+// Expected Body:
+// *service_id - string
+// plan_id - string
+// parameters - json obj
+// previous_values - json obj
+func (h *DbHandler) Update(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	//close body if exists
+	defer func() {
+		if r.Body != nil {
+			e := r.Body.Close()
+			if e != nil {
+				logger.Warn("closing the request body failed", "error", e)
+			}
+		}
+	}()
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	logger = logger.With("instance_id", id)
+
+	// Input validation: check if id is a valid UUID string
+	if IsValidUUID(id) == false {
+		writeError(&status, &body, errInvalidInstanceID)
+		return
+	}
+
+	// Input validation: provided body must be an UpdateRequest targeting a
+	// plan offered by the catalog
+	decoder := json.NewDecoder(r.Body)
+	var updateRequest UpdateRequest
+	err = decoder.Decode(&updateRequest)
+	if err != nil || IsValidUpdateRequest(updateRequest) == false {
+		writeError(&status, &body, NewBadRequestError(
+			"service_id and plan_id, if provided, must be valid UUIDs"))
+		return
+	}
+	logger = logger.With("plan_id", updateRequest.PlanID)
+	plan, ok := h.findPlan(updateRequest.PlanID)
+	if updateRequest.PlanID != "" && !ok {
+		writeError(&status, &body, NewBadRequestError(
+			"Plan "+updateRequest.PlanID+" is not offered by the catalog"))
+		return
+	}
+	if r.URL.Query().Get("accepts_incomplete") == "true" {
+		updateRequest.AcceptsIncomplete = true
+	}
+
+	si, err := h.Store.GetInstance(id)
+	if err == ErrInstanceNotFound {
+		writeError(&status, &body, errUnknownInstance)
+		return
+	}
+	if err != nil {
+		logger.Error("update failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	// Nothing to change
+	if updateRequest.PlanID == "" || updateRequest.PlanID == si.PlanID {
+		status = http.StatusOK
+		writeEmptyJSON(&body)
+		return
+	}
+	if h.RequireAsync && !updateRequest.AcceptsIncomplete {
+		writeError(&status, &body, ErrAsyncRequired)
+		return
+	}
+	op, err := h.StartOperation(id, OperationUpdate)
+	switch {
+	case err == ErrOperationInProgress:
+		writeError(&status, &body, ErrConcurrency)
+		return
+	case err == ErrInstanceNotFound:
+		writeError(&status, &body, errUnknownInstance)
+		return
+	case err != nil:
+		logger.Error("update failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	if updateRequest.AcceptsIncomplete {
+		logger.Info("update started", "operation_id", op.ID)
+		h.runOperation(op, logger, func() error {
+			return h.ChangePlan(id, plan, logger)
+		})
+		status = http.StatusAccepted
+		body, _ = json.Marshal(UpdateResponse{Operation: op.ID})
+		return
+	}
+
+	err = h.ChangePlan(id, plan, logger)
+	h.finishOperation(op, logger, err)
+	if err != nil {
+		logger.Error("update failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+	logger.Info("plan changed")
+	status = http.StatusOK
+	writeEmptyJSON(&body)
+}
+
 //Deprovision deletes a DB service instance
 // expected status codes are 200, 202, 410 and 422 according to Service Broker API
 // specification
 func (h *DbHandler) Deprovision(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
 	var status int
 	var body []byte
 	var err error
@@ -187,18 +434,17 @@ func (h *DbHandler) Deprovision(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(*s)
 		_, err = w.Write(*b)
 		if err != nil {
-			log.Print(err)
+			logger.Warn("writing the response failed", "error", err)
 		}
 	}(&status, &body)
 
 	vars := mux.Vars(r)
 	id := vars["id"]
+	logger = logger.With("instance_id", id)
 
 	// Input validation: check if id is a valid UUID string
 	if IsValidUUID(id) == false {
-		//invalid request implies status code 422
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, errInvalidInstanceID)
 		return
 	}
 
@@ -207,8 +453,7 @@ func (h *DbHandler) Deprovision(w http.ResponseWriter, r *http.Request) {
 	// 1. Did request sent a query params?
 	params := r.URL.Query()
 	if params == nil {
-		status = http.StatusBadRequest
-		writeEmptyJSON(&body)
+		writeError(&status, &body, errInvalidQuery)
 		return
 	}
 	// assign query values to deprovisionRequest fields
@@ -225,25 +470,60 @@ func (h *DbHandler) Deprovision(w http.ResponseWriter, r *http.Request) {
 
 	// Verify if DeprovisionRequest values are valid and expected
 	if valid := IsValidDeprovisionRequest(deprovisionRequest); valid == false {
-		status = http.StatusBadRequest
+		writeError(&status, &body, errInvalidQuery)
+		return
+	}
+	logger = logger.With("plan_id", deprovisionRequest.PlanID)
+	if h.RequireAsync && !deprovisionRequest.AcceptsIncomplete {
+		writeError(&status, &body, ErrAsyncRequired)
+		return
+	}
+	op, err := h.StartOperation(id, OperationDeprovision)
+	switch {
+	case err == ErrOperationInProgress:
+		writeError(&status, &body, ErrConcurrency)
+		return
+	case err == ErrInstanceNotFound:
+		status = http.StatusGone
 		writeEmptyJSON(&body)
 		return
+	case err != nil:
+		logger.Error("deprovision failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
 	}
 
-	rowsAffected, err := h.Remove(id)
-	log.Print("Delete rows affected:", rowsAffected)
+	// Asynchronous deprovision, the container is removed in background
+	if deprovisionRequest.AcceptsIncomplete {
+		logger.Info("deprovision started", "operation_id", op.ID)
+		h.runOperation(op, logger, func() error {
+			_, e := h.Remove(id)
+			return e
+		})
+		status = http.StatusAccepted
+		body, _ = json.Marshal(DeprovisionResponse{
+			ID:        id,
+			Status:    "destroying",
+			Operation: op.ID,
+		})
+		return
+	}
+
+	removed, err := h.Remove(id)
+	h.finishOperation(op, logger, err)
 	if err != nil {
 		// Errors on DB are unexpected and imply internal Broker errors
-		status = http.StatusInternalServerError
-		writeEmptyJSON(&body)
+		logger.Error("deprovision failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
 		return
 	}
-	if rowsAffected == 0 {
+	if !removed {
 		status = http.StatusGone
 		writeEmptyJSON(&body)
 		return
 	}
 
+	logger.Info("instance deprovisioned")
 	status = http.StatusOK
 	body, _ = json.Marshal(DeprovisionResponse{
 		ID:     id,
@@ -251,6 +531,388 @@ func (h *DbHandler) Deprovision(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// LastOperation is executed when the platform polls the state of an
+// asynchronous operation via HTTP GET method
+// vars [id]
+// Query params:
+// operation - string, operation ID returned on the asynchronous response
+// service_id - string
+// plan_id - string
+func (h *DbHandler) LastOperation(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	logger = logger.With("instance_id", id)
+
+	// Input validation: check if id is a valid UUID string
+	if IsValidUUID(id) == false {
+		writeError(&status, &body, errInvalidInstanceID)
+		return
+	}
+
+	op, err := h.Store.GetOperation(id, r.URL.Query().Get("operation"))
+	if err == ErrOperationNotFound {
+		// Unknown operations are reported as gone, the platform considers
+		// the instance deleted
+		status = http.StatusGone
+		writeEmptyJSON(&body)
+		return
+	}
+	if err != nil {
+		logger.Error("reading the operation failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	// Instances over quota report it on every operation description
+	description := op.Description
+	if si, err := h.Store.GetInstance(id); err == nil && si.QuotaExceeded {
+		description += "; " + quotaExceededDescription
+	}
+
+	status = http.StatusOK
+	body, _ = json.Marshal(LastOperationResponse{
+		State:       op.State,
+		Description: description,
+	})
+}
+
+// runOperation executes job in background and records its outcome on the
+// operation registry, logger is the logger of the request starting the
+// operation
+func (h *DbHandler) runOperation(op Operation, logger *slog.Logger, job func() error) {
+	logger = logger.With("operation_id", op.ID, "operation", op.Type)
+	h.jobMutex.Lock()
+	if h.running == nil {
+		h.running = make(map[string]Operation)
+	}
+	h.running[op.ID] = op
+	h.jobMutex.Unlock()
+	h.jobs.Add(1)
+	go func() {
+		defer h.jobs.Done()
+		defer func() {
+			h.jobMutex.Lock()
+			delete(h.running, op.ID)
+			h.jobMutex.Unlock()
+		}()
+		err := job()
+		if err != nil {
+			logger.Error("operation failed", "error", err)
+		} else {
+			logger.Info("operation succeeded")
+		}
+		h.finishOperation(op, logger, err)
+	}()
+}
+
+// finishOperation records the outcome of an operation on the operation
+// registry, err is the error the operation failed with
+func (h *DbHandler) finishOperation(op Operation, logger *slog.Logger, err error) {
+	state := OperationSucceeded
+	description := op.Type + " succeeded"
+	if err != nil {
+		state = OperationFailed
+		description = op.Type + " failed: " + err.Error()
+	}
+	err = h.Store.UpdateOperation(op.ID, state, description)
+	if err != nil {
+		logger.Error("recording the operation outcome failed", "error", err)
+	}
+}
+
+// Bind creates a service binding, a dedicated PostgreSQL role is created on
+// the instance and its credentials are returned to the platform
+// vars [id, binding_id]
+//Expected Body:
+// *plan_id - string
+// *service_id - string
+// app_guid - string
+// bind_resource - json obj
+// parameters - json obj
+func (h *DbHandler) Bind(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	//close body if exists
+	defer func() {
+		if r.Body != nil {
+			e := r.Body.Close()
+			if e != nil {
+				logger.Warn("closing the request body failed", "error", e)
+			}
+		}
+	}()
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	bindingID := vars["binding_id"]
+	logger = logger.With("instance_id", id, "binding_id", bindingID)
+
+	// Input validation: check if both ids are valid UUID strings
+	if IsValidUUID(id) == false || IsValidUUID(bindingID) == false {
+		writeError(&status, &body, errInvalidBindingID)
+		return
+	}
+
+	// Input validation: provided body on request must be compliant with the
+	// definition of the BindRequest type
+	decoder := json.NewDecoder(r.Body)
+	var bindRequest BindRequest
+	err = decoder.Decode(&bindRequest)
+	if err != nil || IsValidBindRequest(bindRequest) == false {
+		writeError(&status, &body, NewBadRequestError(
+			"service_id and plan_id must be valid UUIDs"))
+		return
+	}
+	logger = logger.With("plan_id", bindRequest.PlanID)
+
+	plan, ok := h.findServicePlan(bindRequest.ServiceID, bindRequest.PlanID)
+	if !ok {
+		writeError(&status, &body, NewBadRequestError("Plan "+bindRequest.PlanID+
+			" of service "+bindRequest.ServiceID+" is not offered by the catalog"))
+		return
+	}
+
+	// Plans requiring an application only accept bindings made for one
+	if plan.Limits.RequiresApp && bindRequest.AppGUID == "" && bindRequest.BindResource.AppGUID == "" {
+		writeError(&status, &body, ErrRequiresApp)
+		return
+	}
+
+	// A binding with the same id on the same instance is returned as is when
+	// asked with the same plan and parameters, the same id on another
+	// instance is a conflict
+	sb, err := h.Store.GetBinding(bindingID)
+	switch {
+	case err == nil && sb.InstanceID == id:
+		var si ServiceInstance
+		si, err = h.Store.GetInstance(id)
+		if err != nil {
+			logger.Error("bind failed", "error", err)
+			writeError(&status, &body, NewInternalError(err))
+			return
+		}
+		if si.PlanID != bindRequest.PlanID || !sb.Matches(bindRequest) {
+			writeError(&status, &body, errBindingConflict)
+			return
+		}
+		status = http.StatusOK
+	case err == nil:
+		writeError(&status, &body, &BrokerError{
+			Status:      http.StatusConflict,
+			Description: "Binding " + bindingID + " already exists for another service instance",
+		})
+		return
+	case err == ErrBindingNotFound:
+		sb, err = h.AddBinding(id, bindingID, bindRequest, logger)
+		if err == ErrInstanceNotFound {
+			writeError(&status, &body, errUnknownInstance)
+			return
+		}
+		if err == ErrOperationInProgress {
+			writeError(&status, &body, ErrConcurrency)
+			return
+		}
+		if err != nil {
+			logger.Error("bind failed", "error", err)
+			writeError(&status, &body, NewInternalError(err))
+			return
+		}
+		logger.Info("binding created")
+		status = http.StatusCreated
+	default:
+		logger.Error("bind failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	creds, err := h.credentials(sb)
+	if err != nil {
+		logger.Error("bind failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+	body, _ = json.Marshal(BindResponse{Credentials: creds})
+}
+
+// FetchBinding is executed when the platform reads back a service binding via
+// HTTP GET method, the binding's credentials are returned again
+// vars [id, binding_id]
+// expected status codes are 200 and 404 according to Service Broker API
+// specification
+func (h *DbHandler) FetchBinding(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	bindingID := vars["binding_id"]
+	logger = logger.With("instance_id", id, "binding_id", bindingID)
+
+	// Input validation: check if both ids are valid UUID strings
+	if IsValidUUID(id) == false || IsValidUUID(bindingID) == false {
+		writeError(&status, &body, errInvalidBindingID)
+		return
+	}
+
+	sb, err := h.Store.GetBinding(bindingID)
+	if err == ErrBindingNotFound || (err == nil && sb.InstanceID != id) {
+		writeError(&status, &body, errNoSuchBinding)
+		return
+	}
+	if err != nil {
+		logger.Error("fetching the binding failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+
+	creds, err := h.credentials(sb)
+	if err != nil {
+		logger.Error("fetching the binding failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+	status = http.StatusOK
+	body, _ = json.Marshal(FetchBindingResponse{
+		Credentials: creds,
+		Parameters:  rawParameters(sb.Parameters),
+	})
+}
+
+// Unbind deletes a service binding, the binding's role is dropped from the
+// instance
+// expected status codes are 200 and 410 according to Service Broker API
+// specification
+func (h *DbHandler) Unbind(w http.ResponseWriter, r *http.Request) {
+	logger := h.requestLogger(r)
+	var status int
+	var body []byte
+	var err error
+
+	defer func(s *int, b *[]byte) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*s)
+		_, err = w.Write(*b)
+		if err != nil {
+			logger.Warn("writing the response failed", "error", err)
+		}
+	}(&status, &body)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	bindingID := vars["binding_id"]
+	logger = logger.With("instance_id", id, "binding_id", bindingID)
+
+	// Input validation: check if both ids are valid UUID strings
+	if IsValidUUID(id) == false || IsValidUUID(bindingID) == false {
+		writeError(&status, &body, errInvalidBindingID)
+		return
+	}
+
+	// assign query values to unbindRequest fields
+	params := r.URL.Query()
+	var unbindRequest UnbindRequest
+	unbindRequest.ServiceID = params.Get("service_id")
+	unbindRequest.PlanID = params.Get("plan_id")
+	if valid := IsValidUnbindRequest(unbindRequest); valid == false {
+		writeError(&status, &body, errInvalidQuery)
+		return
+	}
+	logger = logger.With("plan_id", unbindRequest.PlanID)
+
+	removed, err := h.RemoveBinding(id, bindingID)
+	if err == ErrOperationInProgress {
+		writeError(&status, &body, ErrConcurrency)
+		return
+	}
+	if err != nil {
+		logger.Error("unbind failed", "error", err)
+		writeError(&status, &body, NewInternalError(err))
+		return
+	}
+	if !removed {
+		status = http.StatusGone
+		writeEmptyJSON(&body)
+		return
+	}
+
+	logger.Info("binding deleted")
+	status = http.StatusOK
+	writeEmptyJSON(&body)
+}
+
+// credentials builds the credentials block handed out to bound applications,
+// connection details are reported by the provisioner
+func (h *DbHandler) credentials(sb ServiceBinding) (Credentials, error) {
+	si, err := h.Store.GetInstance(sb.InstanceID)
+	if err != nil {
+		return Credentials{}, err
+	}
+	d, err := h.Provisioner.Describe(si)
+	if err != nil {
+		return Credentials{}, err
+	}
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(sb.Username, sb.Password),
+		Host:   net.JoinHostPort(d.Host, strconv.Itoa(d.Port)),
+		Path:   "/" + d.Database,
+	}
+	return Credentials{
+		URI:      u.String(),
+		Host:     d.Host,
+		Port:     d.Port,
+		Username: sb.Username,
+		Password: sb.Password,
+		Database: d.Database,
+	}, nil
+}
+
+// rawParameters returns the parameters recorded in the store as they are
+// served, nil when no parameters were provided
+func rawParameters(parameters string) json.RawMessage {
+	if parameters == "" {
+		return nil
+	}
+	return json.RawMessage(parameters)
+}
+
 func writeEmptyJSON(body *[]byte) {
 	*body, _ = json.Marshal(Empty{})
 }
@@ -18,8 +18,10 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -44,7 +46,8 @@ func TestBrokerCatalog(t *testing.T) {
 
 	// Create response recorder to satisfy http.ResponseWriter
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(Catalog)
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+	handler := http.HandlerFunc(dbhandler.Catalog)
 
 	handler.ServeHTTP(rr, req)
 	//Verify status
@@ -63,10 +66,10 @@ func TestBrokerProvision(t *testing.T) {
 	// request
 	jsonStr := []byte(`
 	{
-		"service_id":"41653aa4-3a3a-486a-4431-ef258b39f042",
-		"plan_id":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
 		"parameters":{},
-		"accepts_incomplete":true,
+		"accepts_incomplete":false,
 		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
 		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
 	}
@@ -103,8 +106,7 @@ func TestBrokerProvision(t *testing.T) {
 	// Create response recorder to satisfy http.ResponseWriter
 	rr := httptest.NewRecorder()
 	// setup handler
-	dbhandler := DbHandler{Name: "sqlite3", Path: "./foo.db"}
-	dbhandler.Setup() // setup database
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
 
 	//Set Mux
 	r := mux.NewRouter()
@@ -135,9 +137,21 @@ func TestBrokerProvision(t *testing.T) {
 		t.Error("Invalid request expects status code 400 (Bad Request) got ", status)
 	}
 
+	// plans must be offered by the catalog for the requested service
+	unknownPlan := bytes.Replace(jsonStr, []byte("83c8811b-f3db-17ef-6eb3-bbe944b47262"), []byte(inexistentID), 1)
+	ir3, err := http.NewRequest("PUT", "/v2/service_instances/"+inexistentID, bytes.NewBuffer(unknownPlan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, ir3)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Error("Unknown plan expects status code 400 (Bad Request) got ", status)
+	}
+
 	time.Sleep(500 * time.Millisecond)
 	// Validate that instance can be deprovisioned
-	brokerDeprovision(t, dbhandler)
+	brokerDeprovision(t, &dbhandler)
 	//test unexpectedDeprovision
 	testUnexpectedDeprovision(t)
 
@@ -145,12 +159,11 @@ func TestBrokerProvision(t *testing.T) {
 
 func testUnexpectedDeprovision(t *testing.T) {
 	// setup handler
-	dbhandler := DbHandler{Name: "sqlite3", Path: "./foo.db"}
-	dbhandler.Setup() // setup database
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
 
 	queryValues := url.Values{}
-	queryValues.Add("service_id", "41653aa4-3a3a-486a-4431-ef258b39f042")
-	queryValues.Add("plan_id", "41653aa4-3a3a-486a-4431-ef258b39f042")
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
 
 	// testing api deprovision endpoint
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/"+inexistentID+"?"+
@@ -175,11 +188,11 @@ func testUnexpectedDeprovision(t *testing.T) {
 
 }
 
-func brokerDeprovision(t *testing.T, dbhandler DbHandler) {
+func brokerDeprovision(t *testing.T, dbhandler *DbHandler) {
 	// testing api deprovision endpoint
 	queryValues := url.Values{}
-	queryValues.Add("service_id", "41653aa4-3a3a-486a-4431-ef258b39f042")
-	queryValues.Add("plan_id", "41653aa4-3a3a-486a-4431-ef258b39f042")
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
 
 	req, err := http.NewRequest("DELETE", "/v2/service_instances/"+testID+"?"+
 		queryValues.Encode(), nil)
@@ -200,3 +213,764 @@ func brokerDeprovision(t *testing.T, dbhandler DbHandler) {
 		t.Error("Deprovision: return wrong status function, obtained ", status)
 	}
 }
+
+// TestBrokerBindValidation validates that malformed binding requests and
+// requests targeting unknown instances or bindings are rejected
+func TestBrokerBindValidation(t *testing.T) {
+	jsonStr := []byte(`
+	{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"bind_resource":{"app_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"}
+	}
+	`)
+	queryValues := url.Values{}
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
+
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Bind).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Unbind).Methods("DELETE")
+
+	tests := []struct {
+		method string
+		uri    string
+		body   []byte
+		status int
+	}{
+		// invalid binding id on the endpoint URI
+		{"PUT", "/v2/service_instances/" + testID + "/service_bindings/" + invalidID, jsonStr, http.StatusBadRequest},
+		// invalid body
+		{"PUT", "/v2/service_instances/" + testID + "/service_bindings/" + testID, []byte(`{"service_id":"123"}`), http.StatusBadRequest},
+		// plan not offered by the catalog
+		{"PUT", "/v2/service_instances/" + testID + "/service_bindings/" + testID,
+			bytes.Replace(jsonStr, []byte("83c8811b-f3db-17ef-6eb3-bbe944b47262"), []byte(inexistentID), 1), http.StatusBadRequest},
+		// binding on an inexistent instance
+		{"PUT", "/v2/service_instances/" + inexistentID + "/service_bindings/" + testID, jsonStr, http.StatusBadRequest},
+		// unbind without query params
+		{"DELETE", "/v2/service_instances/" + testID + "/service_bindings/" + testID, nil, http.StatusBadRequest},
+		// unbind an inexistent binding
+		{"DELETE", "/v2/service_instances/" + testID + "/service_bindings/" + inexistentID + "?" + queryValues.Encode(), nil, http.StatusGone},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.uri, bytes.NewBuffer(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Error(test.method, " ", test.uri, ": expected status ", test.status, " got ", status)
+		}
+	}
+}
+
+// TestBrokerLastOperation validates polling of asynchronous operations for
+// unknown instances and an asynchronous deprovision of an inexistent instance
+func TestBrokerLastOperation(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{id}/last_operation", dbhandler.LastOperation).Methods("GET")
+
+	queryValues := url.Values{}
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
+	queryValues.Add("accepts_incomplete", "true")
+
+	tests := []struct {
+		method string
+		uri    string
+		status int
+	}{
+		{"GET", "/v2/service_instances/" + invalidID + "/last_operation", http.StatusBadRequest},
+		{"GET", "/v2/service_instances/" + inexistentID + "/last_operation", http.StatusGone},
+		{"DELETE", "/v2/service_instances/" + inexistentID + "?" + queryValues.Encode(), http.StatusGone},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Error(test.method, " ", test.uri, ": expected status ", test.status, " got ", status)
+		}
+	}
+}
+
+// TestBrokerUpdateValidation validates that plan updates are rejected for
+// invalid instances and plans not offered by the catalog
+func TestBrokerUpdateValidation(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Update).Methods("PATCH")
+
+	tests := []struct {
+		id     string
+		body   string
+		status int
+	}{
+		// invalid instance id
+		{invalidID, `{"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60"}`, http.StatusBadRequest},
+		// plan not offered by the catalog
+		{testID, `{"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60","plan_id":"` + inexistentID + `"}`,
+			http.StatusBadRequest},
+		// inexistent instance
+		{inexistentID, `{"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60","plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262"}`,
+			http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("PATCH", "/v2/service_instances/"+test.id, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Error("Update ", test.id, ": expected status ", test.status, " got ", status)
+		}
+	}
+}
+
+// TestBrokerBindFlow provisions an instance, binds it, verifies the returned
+// credentials and unbinds it
+func TestBrokerBindFlow(t *testing.T) {
+	const bindingID = "6ab4f79b-6f4c-4b8b-9c1a-1d1f0f1e2a3b"
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Bind).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Unbind).Methods("DELETE")
+
+	queryValues := url.Values{}
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	bindBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262"
+	}`
+	instanceURI := "/v2/service_instances/" + testID
+	bindingURI := instanceURI + "/service_bindings/" + bindingID
+
+	serve := func(method string, uri string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("PUT", instanceURI, provisionBody); rr.Code != http.StatusCreated {
+		t.Fatal("Provision: expected status 201 got ", rr.Code)
+	}
+	defer serve("DELETE", instanceURI+"?"+queryValues.Encode(), "")
+
+	rr := serve("PUT", bindingURI, bindBody)
+	if rr.Code != http.StatusCreated {
+		t.Fatal("Bind: expected status 201 got ", rr.Code)
+	}
+	var resp BindResponse
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := resp.Credentials
+	if c.Username == "" || c.Password == "" || c.Port == 0 || c.Database == "" || c.Host == "" {
+		t.Error("Bind: incomplete credentials ", c)
+	}
+
+	// Binding again returns the same credentials
+	rr = serve("PUT", bindingURI, bindBody)
+	if rr.Code != http.StatusOK {
+		t.Error("Bind: expected status 200 for an existing binding got ", rr.Code)
+	}
+	var again BindResponse
+	err = json.NewDecoder(rr.Body).Decode(&again)
+	if err != nil || again.Credentials != c {
+		t.Error("Bind: existing binding returned different credentials")
+	}
+
+	// Binding again with other parameters or another plan is a conflict
+	otherBodies := []string{`{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"parameters":{"readonly":true}
+	}`, `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"39292da3-de98-2891-11f0-c36a3264dbb5"
+	}`}
+	for _, otherBody := range otherBodies {
+		if rr := serve("PUT", bindingURI, otherBody); rr.Code != http.StatusConflict {
+			t.Error("Bind: expected status 409 for a different binding got ", rr.Code)
+		}
+	}
+
+	if rr := serve("DELETE", bindingURI+"?"+queryValues.Encode(), ""); rr.Code != http.StatusOK {
+		t.Error("Unbind: expected status 200 got ", rr.Code)
+	}
+	if rr := serve("DELETE", bindingURI+"?"+queryValues.Encode(), ""); rr.Code != http.StatusGone {
+		t.Error("Unbind: expected status 410 got ", rr.Code)
+	}
+}
+
+// bindings without an application are rejected on plans requiring one
+func TestBrokerBindRequiresApp(t *testing.T) {
+	const bindingID = "6ab4f79b-6f4c-4b8b-9c1a-1d1f0f1e2a3b"
+	catalog := defaultCatalog()
+	catalog.Services[0].Plans[0].Limits.RequiresApp = true
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner(),
+		Services: catalog.Services}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Bind).Methods("PUT")
+
+	serve := func(method string, uri string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	instanceURI := "/v2/service_instances/" + testID
+	rr := serve("PUT", instanceURI, `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatal("Provision: expected status 201 got ", rr.Code)
+	}
+
+	bindingURI := instanceURI + "/service_bindings/" + bindingID
+	rr = serve("PUT", bindingURI, `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262"
+	}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatal("Bind without application: expected status 422 got ", rr.Code)
+	}
+	var resp BrokerError
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || resp.Code != "RequiresApp" {
+		t.Error("Bind without application: expected RequiresApp error got ", resp)
+	}
+
+	rr = serve("PUT", bindingURI, `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"bind_resource":{"app_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"}
+	}`)
+	if rr.Code != http.StatusCreated {
+		t.Error("Bind for an application: expected status 201 got ", rr.Code)
+	}
+}
+
+// TestBrokerAsyncProvision provisions an instance asynchronously and polls
+// last_operation until the operation succeeds
+func TestBrokerAsyncProvision(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{id}/last_operation", dbhandler.LastOperation).Methods("GET")
+
+	jsonStr := []byte(`
+	{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}
+	`)
+	req, err := http.NewRequest("PUT", "/v2/service_instances/"+testID+"?accepts_incomplete=true",
+		bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Fatal("Provision: expected status 202 got ", status)
+	}
+	var resp ProvisionResponse
+	err = json.NewDecoder(rr.Body).Decode(&resp)
+	if err != nil || resp.Operation == "" {
+		t.Fatal("Provision: asynchronous response without operation")
+	}
+
+	var last LastOperationResponse
+	for i := 0; i < 20; i++ {
+		req, err = http.NewRequest("GET", "/v2/service_instances/"+testID+"/last_operation?operation="+
+			resp.Operation, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		err = json.NewDecoder(rr.Body).Decode(&last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last.State != OperationInProgress {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if last.State != OperationSucceeded {
+		t.Error("LastOperation: expected state succeeded got ", last.State, ": ", last.Description)
+	}
+
+	brokerDeprovision(t, &dbhandler)
+}
+
+// TestBrokerProvisionIdempotency validates that retried provision requests
+// are answered with the existing instance and conflicting ones are rejected
+func TestBrokerProvisionIdempotency(t *testing.T) {
+	const instanceID = "2b8e3f4a-5c6d-4e7f-8a9b-0c1d2e3f4a5b"
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Deprovision).Methods("DELETE")
+
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	otherSpaceBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"` + inexistentID + `"
+	}`
+	otherPlanBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"39292da3-de98-2891-11f0-c36a3264dbb5",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	otherParametersBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"parameters":{"locale":"C"}
+	}`
+	queryValues := url.Values{}
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
+	instanceURI := "/v2/service_instances/" + instanceID
+
+	tests := []struct {
+		method string
+		uri    string
+		body   string
+		status int
+	}{
+		{"PUT", instanceURI, provisionBody, http.StatusCreated},
+		{"PUT", instanceURI, provisionBody, http.StatusOK},
+		{"PUT", instanceURI, otherSpaceBody, http.StatusConflict},
+		{"PUT", instanceURI, otherPlanBody, http.StatusConflict},
+		{"PUT", instanceURI, otherParametersBody, http.StatusConflict},
+		{"DELETE", instanceURI + "?" + queryValues.Encode(), "", http.StatusOK},
+		{"PUT", instanceURI, otherSpaceBody, http.StatusCreated},
+		{"DELETE", instanceURI + "?" + queryValues.Encode(), "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.uri, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Error(test.method, " ", test.uri, ": expected status ", test.status, " got ", status)
+		}
+	}
+}
+
+// targetProvisioner reports every instance on an internal address, so that
+// the instances are forwarded
+type targetProvisioner struct {
+	*MemoryProvisioner
+}
+
+func (p targetProvisioner) Describe(si ServiceInstance) (InstanceDetails, error) {
+	d, err := p.MemoryProvisioner.Describe(si)
+	d.Target = "172.17.0.2:5432"
+	return d, err
+}
+
+// failingForwarder applies the rules it is given but reports a failure while
+// fail is set
+type failingForwarder struct {
+	*MemoryForwarder
+	fail bool
+}
+
+func (f *failingForwarder) Add(rule ForwardRule) error {
+	f.MemoryForwarder.Add(rule)
+	if f.fail {
+		return errors.New("forwarding failed")
+	}
+	return nil
+}
+
+// TestBrokerProvisionRetry validates that a provision failing after the
+// instance was created leaves nothing behind, so the platform can retry it
+func TestBrokerProvisionRetry(t *testing.T) {
+	provisioner := NewMemoryProvisioner()
+	forwarder := &failingForwarder{MemoryForwarder: NewMemoryForwarder(), fail: true}
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: targetProvisioner{provisioner},
+		Forwarder: forwarder}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	provision := func() int {
+		req, err := http.NewRequest("PUT", "/v2/service_instances/"+testID, bytes.NewBufferString(`{
+			"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+			"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+			"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+			"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := provision(); status != http.StatusInternalServerError {
+		t.Fatal("Expected the provision to fail, got ", status)
+	}
+	if d, _ := provisioner.Describe(ServiceInstance{ID: testID}); d.Running {
+		t.Error("Instance of the failed provision not destroyed")
+	}
+	if rules := forwarder.Rules(); len(rules) != 0 {
+		t.Error("Forward rule of the failed provision not removed ", rules)
+	}
+
+	forwarder.fail = false
+	if status := provision(); status != http.StatusCreated {
+		t.Error("Retried provision: expected status 201 got ", status)
+	}
+}
+
+// TestBrokerAsyncProvisionRetry validates that a failed asynchronous
+// provision is cleaned up and provisioned again when the platform retries it
+func TestBrokerAsyncProvisionRetry(t *testing.T) {
+	provisioner := NewMemoryProvisioner()
+	forwarder := &failingForwarder{MemoryForwarder: NewMemoryForwarder(), fail: true}
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: targetProvisioner{provisioner},
+		Forwarder: forwarder}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	provision := func(async bool) int {
+		uri := "/v2/service_instances/" + testID
+		if async {
+			uri += "?accepts_incomplete=true"
+		}
+		req, err := http.NewRequest("PUT", uri, bytes.NewBufferString(`{
+			"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+			"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+			"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+			"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := provision(true); status != http.StatusAccepted {
+		t.Fatal("Provision: expected status 202 got ", status)
+	}
+	if err := dbhandler.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if op, err := dbhandler.Store.GetOperation(testID, ""); err != nil || op.State != OperationFailed {
+		t.Fatal("Expected the provision to fail, got ", op, err)
+	}
+	if _, err := dbhandler.Store.GetInstance(testID); err != ErrInstanceNotFound {
+		t.Error("Instance of the failed provision not forgotten ", err)
+	}
+	if count, _ := dbhandler.Store.CountPorts(dbhandler.portRange()); count != 0 {
+		t.Error("Port of the failed provision not released")
+	}
+	if d, _ := provisioner.Describe(ServiceInstance{ID: testID}); d.Running {
+		t.Error("Instance of the failed provision not destroyed")
+	}
+
+	forwarder.fail = false
+	if status := provision(true); status != http.StatusAccepted {
+		t.Fatal("Retried provision: expected status 202 got ", status)
+	}
+	if err := dbhandler.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if op, err := dbhandler.Store.GetOperation(testID, ""); err != nil || op.State != OperationSucceeded {
+		t.Error("Expected the retried provision to succeed, got ", op, err)
+	}
+	if status := provision(true); status != http.StatusOK {
+		t.Error("Provisioned instance: expected status 200 got ", status)
+	}
+
+	// A registration left behind by a failed provision, such as one
+	// interrupted by a shutdown, is provisioned again
+	if _, err := dbhandler.Remove(testID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbhandler.Register(testID, ProvisionRequest{
+		ServiceID: "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60", PlanID: "83c8811b-f3db-17ef-6eb3-bbe944b47262",
+	}, dbhandler.logger()); err != nil {
+		t.Fatal(err)
+	}
+	op, err := dbhandler.AddOperation(testID, OperationProvision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dbhandler.Store.UpdateOperation(op.ID, OperationFailed, "provision failed"); err != nil {
+		t.Fatal(err)
+	}
+	if status := provision(false); status != http.StatusCreated {
+		t.Error("Provision of a failed instance: expected status 201 got ", status)
+	}
+	if status := provision(false); status != http.StatusOK {
+		t.Error("Provisioned instance: expected status 200 got ", status)
+	}
+}
+
+// TestBrokerProvisionNoPort validates that provisioning fails once every port
+// of the range is allocated
+func TestBrokerProvisionNoPort(t *testing.T) {
+	const instanceID = "3c9f4a5b-6d7e-4f8a-9b0c-1d2e3f4a5b6c"
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner(),
+		Ports: PortRange{Min: 6000, Max: 6000}}
+	_, err := dbhandler.Store.AllocatePort(testID, dbhandler.Ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	req, err := http.NewRequest("PUT", "/v2/service_instances/"+instanceID, bytes.NewBufferString(provisionBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Error("Provision: expected status 503 got ", rr.Code)
+	}
+	if _, err = dbhandler.Store.GetInstance(instanceID); err != ErrInstanceNotFound {
+		t.Error("Instance registered without port ", err)
+	}
+}
+
+// sharedPortProvisioner serves every instance on the same port, as the
+// cluster provisioner does. Instances report a target so that forwarding
+// would be attempted if the broker did not skip it
+type sharedPortProvisioner struct {
+	*MemoryProvisioner
+}
+
+func (p sharedPortProvisioner) NeedsPort() bool {
+	return false
+}
+
+func (p sharedPortProvisioner) Describe(si ServiceInstance) (InstanceDetails, error) {
+	d, err := p.MemoryProvisioner.Describe(si)
+	d.Port = 5432
+	d.Target = "172.17.0.2:5432"
+	return d, err
+}
+
+// TestBrokerProvisionSharedPort validates that provisioners serving instances
+// on a shared port provision more instances than the port range holds
+func TestBrokerProvisionSharedPort(t *testing.T) {
+	forwarder := NewMemoryForwarder()
+	dbhandler := DbHandler{Store: NewMemoryStore(),
+		Provisioner: sharedPortProvisioner{NewMemoryProvisioner()},
+		Ports:       PortRange{Min: 6000, Max: 6000}, Forwarder: forwarder}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	for _, id := range []string{testID, inexistentID, "3c9f4a5b-6d7e-4f8a-9b0c-1d2e3f4a5b6c"} {
+		req, err := http.NewRequest("PUT", "/v2/service_instances/"+id, bytes.NewBufferString(provisionBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatal("Provision ", id, ": expected status 201 got ", rr.Code)
+		}
+	}
+
+	if count, err := dbhandler.Store.CountPorts(dbhandler.Ports); err != nil || count != 0 {
+		t.Error("Ports allocated to instances on a shared port ", count, err)
+	}
+	if rules, err := dbhandler.Store.ListForwardRules(); err != nil || len(rules) != 0 {
+		t.Error("Forward rules recorded for instances on a shared port ", rules, err)
+	}
+	if len(forwarder.Rules()) != 0 {
+		t.Error("Forward rules applied for instances on a shared port ", forwarder.Rules())
+	}
+}
+
+func TestBrokerFetch(t *testing.T) {
+	const bindingID = "6ab4f79b-6f4c-4b8b-9c1a-1d1f0f1e2a3b"
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+	for _, s := range dbhandler.catalog().Services {
+		if !s.InstancesRetrievable || !s.BindingsRetrievable {
+			t.Error("Fetch endpoints not advertised by service ", s.Name)
+		}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.FetchInstance).Methods("GET")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.Bind).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}/service_bindings/{binding_id}", dbhandler.FetchBinding).Methods("GET")
+
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"parameters":{"locale":"en_US"}
+	}`
+	bindBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"parameters":{"read_only":true}
+	}`
+	instanceURI := "/v2/service_instances/" + testID
+	bindingURI := instanceURI + "/service_bindings/" + bindingID
+
+	serve := func(method string, uri string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("GET", instanceURI, ""); rr.Code != http.StatusNotFound {
+		t.Error("Fetch unknown instance: expected status 404 got ", rr.Code)
+	}
+	if rr := serve("PUT", instanceURI, provisionBody); rr.Code != http.StatusCreated {
+		t.Fatal("Provision: expected status 201 got ", rr.Code)
+	}
+	rr := serve("GET", instanceURI, "")
+	if rr.Code != http.StatusOK {
+		t.Fatal("Fetch instance: expected status 200 got ", rr.Code)
+	}
+	var instance FetchInstanceResponse
+	err := json.NewDecoder(rr.Body).Decode(&instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.ServiceID != "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60" ||
+		instance.PlanID != "83c8811b-f3db-17ef-6eb3-bbe944b47262" ||
+		string(instance.Parameters) != `{"locale":"en_US"}` {
+		t.Error("Fetch instance: unexpected response ", instance)
+	}
+
+	if rr := serve("GET", bindingURI, ""); rr.Code != http.StatusNotFound {
+		t.Error("Fetch unknown binding: expected status 404 got ", rr.Code)
+	}
+	rr = serve("PUT", bindingURI, bindBody)
+	if rr.Code != http.StatusCreated {
+		t.Fatal("Bind: expected status 201 got ", rr.Code)
+	}
+	var bound BindResponse
+	err = json.NewDecoder(rr.Body).Decode(&bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = serve("GET", bindingURI, "")
+	if rr.Code != http.StatusOK {
+		t.Fatal("Fetch binding: expected status 200 got ", rr.Code)
+	}
+	var binding FetchBindingResponse
+	err = json.NewDecoder(rr.Body).Decode(&binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.Credentials != bound.Credentials || string(binding.Parameters) != `{"read_only":true}` {
+		t.Error("Fetch binding: unexpected response ", binding)
+	}
+	otherURI := "/v2/service_instances/" + inexistentID + "/service_bindings/" + bindingID
+	if rr := serve("GET", otherURI, ""); rr.Code != http.StatusNotFound {
+		t.Error("Fetch binding of another instance: expected status 404 got ", rr.Code)
+	}
+
+	// the quota state is reported along with the usage and the plan's quota
+	dbhandler.Provisioner.(*MemoryProvisioner).SetSize(testID, 6*bytesPerMB)
+	if err = dbhandler.CheckQuotas(); err != nil {
+		t.Fatal(err)
+	}
+	rr = serve("GET", instanceURI, "")
+	instance = FetchInstanceResponse{}
+	err = json.NewDecoder(rr.Body).Decode(&instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !instance.QuotaExceeded || instance.UsageBytes != 6*bytesPerMB || instance.QuotaBytes != 5*bytesPerMB {
+		t.Error("Fetch instance over quota: unexpected response ", instance)
+	}
+
+	// instances being updated cannot be fetched
+	_, err = dbhandler.AddOperation(testID, OperationUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := serve("GET", instanceURI, ""); rr.Code != http.StatusUnprocessableEntity {
+		t.Error("Fetch instance being updated: expected status 422 got ", rr.Code)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authRealm is announced on the WWW-Authenticate header of 401 responses
+const authRealm = "cf-postgresql-broker"
+
+// Credential is a broker username along with the bcrypt hash of its password
+type Credential struct {
+	Username     string
+	PasswordHash []byte
+}
+
+// Authenticator validates HTTP Basic Authentication credentials of the
+// platform. Several credentials can be active at once so they can be rotated
+// without downtime: add the new credential, update the broker on the platform
+// and remove the old one
+type Authenticator struct {
+	mutex       sync.RWMutex
+	credentials []Credential
+}
+
+// dummyHash is compared against when the username is unknown so that
+// responses take the same time whether the user exists or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// LoadCredentials reads a credentials file, each line holds a username and a
+// bcrypt password hash separated by a colon, as generated by
+// "htpasswd -nB username". Empty lines and lines starting with # are ignored
+func LoadCredentials(path string) ([]Credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var credentials []Credential
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, n)
+		}
+		hash := []byte(line[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: password must be a bcrypt hash: %v", path, n, err)
+		}
+		credentials = append(credentials, Credential{Username: line[:i], PasswordHash: hash})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("%s: no credentials defined", path)
+	}
+	return credentials, nil
+}
+
+// NewAuthenticator returns an Authenticator accepting the credentials
+func NewAuthenticator(credentials []Credential) *Authenticator {
+	a := &Authenticator{}
+	a.SetCredentials(credentials)
+	return a
+}
+
+// SetCredentials replaces the accepted credentials
+func (a *Authenticator) SetCredentials(credentials []Credential) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.credentials = credentials
+}
+
+// Valid reports whether the username and password match any credential, a
+// username may be listed with several passwords while they are rotated
+func (a *Authenticator) Valid(username string, password string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	found := false
+	valid := false
+	for _, c := range a.credentials {
+		if subtle.ConstantTimeCompare([]byte(c.Username), []byte(username)) == 1 {
+			found = true
+			if bcrypt.CompareHashAndPassword(c.PasswordHash, []byte(password)) == nil {
+				valid = true
+			}
+		}
+	}
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	}
+	return valid
+}
+
+// Middleware rejects requests without valid credentials with 401
+// Unauthorized
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !a.Valid(username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+			respondError(w, &BrokerError{
+				Status:      http.StatusUnauthorized,
+				Description: "Valid broker credentials are required",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeCredentialsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCredentials(t *testing.T) {
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("old"), bcrypt.MinCost)
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("new"), bcrypt.MinCost)
+	path := writeCredentialsFile(t, "# rotation in progress\n"+
+		"broker:"+string(oldHash)+"\n\n"+
+		"broker2:"+string(newHash)+"\n")
+
+	credentials, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator(credentials)
+	switch {
+	case !a.Valid("broker", "old"):
+		t.Error("Old credential rejected")
+	case !a.Valid("broker2", "new"):
+		t.Error("New credential rejected")
+	case a.Valid("broker", "new"):
+		t.Error("Password of another user accepted")
+	case a.Valid("unknown", "old"):
+		t.Error("Unknown user accepted")
+	}
+
+	for _, content := range []string{"", "broker:plaintext\n", "nocolon\n"} {
+		_, err = LoadCredentials(writeCredentialsFile(t, content))
+		if err == nil {
+			t.Errorf("Invalid credentials file %q accepted", content)
+		}
+	}
+	_, err = LoadCredentials(filepath.Join(os.TempDir(), "inexistent-credentials"))
+	if err == nil {
+		t.Error("Inexistent credentials file accepted")
+	}
+}
+
+// both passwords of a username are accepted while they are rotated
+func TestAuthenticatorRotation(t *testing.T) {
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("old"), bcrypt.MinCost)
+	newHash, _ := bcrypt.GenerateFromPassword([]byte("new"), bcrypt.MinCost)
+	a := NewAuthenticator([]Credential{
+		{Username: "broker", PasswordHash: oldHash},
+		{Username: "broker", PasswordHash: newHash},
+	})
+	switch {
+	case !a.Valid("broker", "old"):
+		t.Error("Old password rejected during rotation")
+	case !a.Valid("broker", "new"):
+		t.Error("New password rejected during rotation")
+	case a.Valid("broker", "other"):
+		t.Error("Wrong password accepted during rotation")
+	}
+
+	// Once rotated the old password is rejected
+	a.SetCredentials([]Credential{{Username: "broker", PasswordHash: newHash}})
+	if a.Valid("broker", "old") || !a.Valid("broker", "new") {
+		t.Error("Rotated credentials not applied")
+	}
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	a := NewAuthenticator([]Credential{{Username: "broker", PasswordHash: hash}})
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		username string
+		password string
+		status   int
+	}{
+		{"broker", "secret", http.StatusOK},
+		{"broker", "wrong", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/v2/catalog", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Error("Expected status ", test.status, " got ", rr.Code)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Error("401 response without WWW-Authenticate header")
+		}
+	}
+}
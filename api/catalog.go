@@ -0,0 +1,244 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// catalogFile is the layout of a catalog file, services and plans follow the
+// /v2/catalog objects and plans carry the backend settings not served to the
+// platform
+type catalogFile struct {
+	Services []serviceFile `json:"services"`
+}
+
+type serviceFile struct {
+	Service
+	Plans []planFile `json:"plans"`
+}
+
+type planFile struct {
+	Plan
+	Backend PlanLimits `json:"backend"`
+}
+
+// defaultCatalog returns the services and plans offered by the broker when
+// no catalog file is provided, plan limits are applied to the provisioned
+// instances
+func defaultCatalog() CatalogObject {
+	plans := []Plan{
+		{
+			ID:          "83c8811b-f3db-17ef-6eb3-bbe944b47262",
+			Name:        "5mb",
+			Description: "5 mb of psql database",
+			Metadata:    nil,
+			Free:        true,
+			Bindable:    true,
+			Limits: PlanLimits{
+				StorageMB: 5,
+				MemoryMB:  128,
+			},
+		},
+		{
+			ID:          "39292da3-de98-2891-11f0-c36a3264dbb5",
+			Name:        "50mb",
+			Description: "50 mb of psql database",
+			Free:        true,
+			Bindable:    true,
+			Limits: PlanLimits{
+				StorageMB: 50,
+				MemoryMB:  256,
+			},
+		},
+	}
+
+	data := Service{
+		Name:           "postgresql",
+		ID:             "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		Description:    "A postgresql DB service",
+		Tags:           []string{"postgresql", "relational"},
+		Requires:       []string{},
+		Bindable:       true,
+		Metadata:       nil,
+		PlanUpdateable: true,
+		Plans:          plans,
+	}
+	data.InstancesRetrievable = true
+	data.BindingsRetrievable = true
+	return CatalogObject{
+		[]Service{data},
+	}
+}
+
+// LoadCatalog reads a YAML or JSON catalog file, the catalog is validated
+// before being returned
+func LoadCatalog(path string) (CatalogObject, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return CatalogObject{}, err
+	}
+	return ParseCatalog(b)
+}
+
+// ParseCatalog decodes and validates a YAML or JSON catalog document
+func ParseCatalog(b []byte) (CatalogObject, error) {
+	var f catalogFile
+	err := yaml.UnmarshalStrict(b, &f)
+	if err != nil {
+		return CatalogObject{}, err
+	}
+
+	catalog := CatalogObject{Services: []Service{}}
+	for _, sf := range f.Services {
+		s := sf.Service
+		s.Plans = []Plan{}
+		for _, pf := range sf.Plans {
+			p := pf.Plan
+			p.Limits = pf.Backend
+			s.Plans = append(s.Plans, p)
+		}
+		// Empty lists are served as [] rather than null
+		if s.Tags == nil {
+			s.Tags = []string{}
+		}
+		if s.Requires == nil {
+			s.Requires = []string{}
+		}
+		s.InstancesRetrievable = true
+		s.BindingsRetrievable = true
+		catalog.Services = append(catalog.Services, s)
+	}
+
+	err = ValidateCatalog(catalog)
+	if err != nil {
+		return CatalogObject{}, err
+	}
+	return catalog, nil
+}
+
+// ValidateCatalog verifies that the catalog offers at least a service, that
+// services and plans have their required fields and that every ID is a
+// unique UUID. All problems found are reported on the returned error
+func ValidateCatalog(c CatalogObject) error {
+	var problems []string
+	ids := make(map[string]string)
+	fail := func(where string, format string, a ...interface{}) {
+		problems = append(problems, where+": "+fmt.Sprintf(format, a...))
+	}
+	checkID := func(where string, id string) {
+		switch {
+		case IsValidUUID(id) == false:
+			fail(where, "id %q is not a valid UUID", id)
+		case ids[id] != "":
+			fail(where, "id %s is already used by %s", id, ids[id])
+		default:
+			ids[id] = where
+		}
+	}
+
+	if len(c.Services) == 0 {
+		return errors.New("catalog: at least one service is required")
+	}
+	serviceNames := make(map[string]bool)
+	for i, s := range c.Services {
+		where := fmt.Sprintf("services[%d]", i)
+		checkID(where, s.ID)
+		switch {
+		case s.Name == "":
+			fail(where, "name is required")
+		case serviceNames[s.Name]:
+			fail(where, "name %q is already used", s.Name)
+		}
+		serviceNames[s.Name] = true
+		if s.Description == "" {
+			fail(where, "description is required")
+		}
+		if d := s.DClient; d != nil && (d.ID == "" || d.Secret == "" || d.RedirectURI == "") {
+			fail(where, "dashboard_client requires id, secret and redirect_uri")
+		}
+		if len(s.Plans) == 0 {
+			fail(where, "at least one plan is required")
+		}
+
+		planNames := make(map[string]bool)
+		for j, p := range s.Plans {
+			where := fmt.Sprintf("services[%d].plans[%d]", i, j)
+			checkID(where, p.ID)
+			switch {
+			case p.Name == "":
+				fail(where, "name is required")
+			case planNames[p.Name]:
+				fail(where, "name %q is already used", p.Name)
+			}
+			planNames[p.Name] = true
+			if p.Description == "" {
+				fail(where, "description is required")
+			}
+			if p.Limits.StorageMB < 0 || p.Limits.MemoryMB < 0 {
+				fail(where, "backend limits must not be negative")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("catalog: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// catalog returns the catalog served by the handler
+func (h *DbHandler) catalog() CatalogObject {
+	if h.Services == nil {
+		return defaultCatalog()
+	}
+	return CatalogObject{Services: h.Services}
+}
+
+// findPlan looks up a plan in the catalog by its ID, returns false if the
+// catalog does not offer such plan
+func (h *DbHandler) findPlan(planID string) (Plan, bool) {
+	for _, s := range h.catalog().Services {
+		for _, p := range s.Plans {
+			if p.ID == planID {
+				return p, true
+			}
+		}
+	}
+	return Plan{}, false
+}
+
+// findServicePlan looks up a plan of a service in the catalog, returns false
+// if the catalog does not offer such plan for the service
+func (h *DbHandler) findServicePlan(serviceID string, planID string) (Plan, bool) {
+	for _, s := range h.catalog().Services {
+		if s.ID != serviceID {
+			continue
+		}
+		for _, p := range s.Plans {
+			if p.ID == planID {
+				return p, true
+			}
+		}
+	}
+	return Plan{}, false
+}
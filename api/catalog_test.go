@@ -0,0 +1,82 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := LoadCatalog("../catalog.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 1 || len(catalog.Services[0].Plans) != 2 {
+		t.Fatal("Unexpected catalog ", catalog)
+	}
+	p := catalog.Services[0].Plans[0]
+	if p.Limits.StorageMB != 5 || p.Limits.MemoryMB != 128 {
+		t.Error("Plan backend settings not loaded ", p.Limits)
+	}
+
+	h := DbHandler{Services: catalog.Services}
+	if _, ok := h.findPlan("39292da3-de98-2891-11f0-c36a3264dbb5"); !ok {
+		t.Error("Plan of the loaded catalog not found")
+	}
+}
+
+func TestParseCatalogJSON(t *testing.T) {
+	catalog, err := ParseCatalog([]byte(`{"services":[{
+		"id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60","name":"pg","description":"d",
+		"plans":[{"id":"83c8811b-f3db-17ef-6eb3-bbe944b47262","name":"small","description":"d"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catalog.Services[0].Tags == nil || catalog.Services[0].DClient != nil {
+		t.Error("Optional service fields not defaulted ", catalog.Services[0])
+	}
+}
+
+func TestParseCatalogInvalid(t *testing.T) {
+	tests := []struct {
+		doc     string
+		problem string
+	}{
+		{`services: []`, "at least one service"},
+		{`services: [{id: "1", name: pg, description: d,
+			plans: [{id: 83c8811b-f3db-17ef-6eb3-bbe944b47262, name: small, description: d}]}]`,
+			"not a valid UUID"},
+		{`services: [{id: 83c8811b-f3db-17ef-6eb3-bbe944b47262, name: pg, description: d,
+			plans: [{id: 83c8811b-f3db-17ef-6eb3-bbe944b47262, name: small, description: d}]}]`,
+			"already used"},
+		{`services: [{id: 5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60, description: d, plans: []}]`,
+			"name is required"},
+		{`services: [{id: 5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60, name: pg, description: d,
+			dashboard_client: {id: pg},
+			plans: [{id: 83c8811b-f3db-17ef-6eb3-bbe944b47262, name: small, description: d}]}]`,
+			"dashboard_client"},
+		{`services: [{id: 5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60, name: pg, description: d, unknown: 1}]`,
+			"unknown"},
+	}
+	for _, test := range tests {
+		_, err := ParseCatalog([]byte(test.doc))
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Error("Expected error containing ", test.problem, " got ", err)
+		}
+	}
+}
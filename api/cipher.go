@@ -0,0 +1,228 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// StateKeyEnv is the environment variable holding the state encryption keys
+// when no key file is configured, keys are separated by commas
+const StateKeyEnv = "BROKER_STATE_KEY"
+
+const (
+	// stateKeyBytes is the size of state encryption keys and data keys,
+	// AES-256
+	stateKeyBytes = 32
+	// keyIDBytes is the size of the SHA-256 prefix identifying a key
+	keyIDBytes = 8
+)
+
+// errNoStateKey is returned when secrets are stored or read without an
+// encryption key
+var errNoStateKey = errors.New("no state encryption key configured")
+
+// Keyring encrypts the secrets kept in the state database with envelope
+// encryption: every secret is sealed with its own random data key, which is
+// sealed in turn with the current master key. Master keys are identified by
+// the prefix of their SHA-256 digest, recorded along with the secrets.
+//
+// Previous master keys are only used to decrypt, secrets are moved to the
+// current key with SQLStore.RotateKeys
+type Keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+// masterKey is a key encrypting data keys
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a Keyring encrypting with the first of the 32 bytes
+// keys and decrypting with any of them
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errNoStateKey
+	}
+	k := &Keyring{keys: make(map[string]*masterKey)}
+	for _, key := range keys {
+		if len(key) != stateKeyBytes {
+			return nil, fmt.Errorf("state encryption key must be %d bytes, got %d", stateKeyBytes, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(key)
+		m := &masterKey{id: hex.EncodeToString(digest[:keyIDBytes]), aead: aead}
+		if k.current == nil {
+			k.current = m
+		}
+		k.keys[m.id] = m
+	}
+	return k, nil
+}
+
+// ParseStateKeys decodes base64 encoded state encryption keys separated by
+// commas or new lines, the current key first
+func ParseStateKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("state encryption key must be base64 encoded: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errNoStateKey
+	}
+	return keys, nil
+}
+
+// LoadStateKeys reads base64 encoded state encryption keys from a file, one
+// per line with the current key first
+func LoadStateKeys(path string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseStateKeys(string(b))
+}
+
+// KeyID returns the ID of the current master key
+func (k *Keyring) KeyID() string {
+	return k.current.id
+}
+
+// Encrypt seals plaintext with a new data key sealed with the current master
+// key. Returns the base64 encoded sealed data key followed by the sealed
+// plaintext, along with the ID of the master key
+func (k *Keyring) Encrypt(plaintext string) (string, string, error) {
+	dataKey := make([]byte, stateKeyBytes)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	sealedKey, err := seal(k.current.aead, dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(append(sealedKey, sealed...)), k.current.id, nil
+}
+
+// Decrypt opens a value returned by Encrypt with the master key keyID
+func (k *Keyring) Decrypt(ciphertext string, keyID string) (string, error) {
+	m, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("secret encrypted with unknown state key %q", keyID)
+	}
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	sealedKeyBytes := m.aead.NonceSize() + stateKeyBytes + m.aead.Overhead()
+	if len(b) < sealedKeyBytes {
+		return "", errors.New("encrypted secret is truncated")
+	}
+	dataKey, err := open(m.aead, b[:sealedKeyBytes])
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, b[sealedKeyBytes:])
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// decryptUnwrapped opens a secret sealed directly with a master key, as done
+// before envelope encryption. Every key is tried since the key was not
+// recorded
+func (k *Keyring) decryptUnwrapped(ciphertext string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range k.keys {
+		plaintext, err := open(m.aead, b)
+		if err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", errors.New("secret cannot be decrypted with the state encryption keys")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext under a random nonce prepended to the result
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a value returned by seal
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted secret is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("secret cannot be decrypted with the state encryption key")
+	}
+	return plaintext, nil
+}
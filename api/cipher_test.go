@@ -0,0 +1,191 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Base64 encoded 32 bytes keys
+const (
+	testStateKey    = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testNewStateKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func testKeyring(t *testing.T, keys ...string) *Keyring {
+	if len(keys) == 0 {
+		keys = []string{testStateKey}
+	}
+	parsed, err := ParseStateKeys(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring(parsed...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyring(t *testing.T) {
+	k := testKeyring(t)
+	encrypted, keyID, err := k.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "secret") || keyID != k.KeyID() {
+		t.Error("Unexpected encryption ", encrypted, keyID)
+	}
+	if again, _, _ := k.Encrypt("secret"); again == encrypted {
+		t.Error("Data key reused between encryptions")
+	}
+	decrypted, err := k.Decrypt(encrypted, keyID)
+	if err != nil || decrypted != "secret" {
+		t.Error("Expected decrypted secret got ", decrypted, err)
+	}
+
+	// previous keys decrypt, the first key encrypts
+	rotated := testKeyring(t, testNewStateKey, testStateKey)
+	if rotated.KeyID() == keyID {
+		t.Error("Keys share the same ID")
+	}
+	if decrypted, err := rotated.Decrypt(encrypted, keyID); err != nil || decrypted != "secret" {
+		t.Error("Secret not decrypted with a previous key ", decrypted, err)
+	}
+	if _, err := testKeyring(t, testNewStateKey).Decrypt(encrypted, keyID); err == nil {
+		t.Error("Secret decrypted without its key")
+	}
+
+	if _, err := NewKeyring([]byte("short")); err == nil {
+		t.Error("Short key accepted")
+	}
+	if _, err := ParseStateKeys("not base64!"); err == nil {
+		t.Error("Key not base64 encoded accepted")
+	}
+	if _, err := ParseStateKeys("\n"); err != errNoStateKey {
+		t.Error("Expected errNoStateKey without keys got ", err)
+	}
+}
+
+func TestSQLiteStoreEncryptsSecrets(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si := ServiceInstance{ID: testID, Port: 5432, AdminPassword: "admin-secret"}
+	if err = s.CreateInstance(si); err != errNoStateKey {
+		t.Error("Expected errNoStateKey without keyring got ", err)
+	}
+	s.SetKeyring(testKeyring(t))
+	if err = s.CreateInstance(si); err != nil {
+		t.Fatal(err)
+	}
+	sb := ServiceBinding{ID: inexistentID, InstanceID: testID, Username: "user", Password: "binding-secret"}
+	if err = s.CreateBinding(sb); err != nil {
+		t.Fatal(err)
+	}
+	var stored, keyID string
+	err = s.db.QueryRow("SELECT admin_password, key_id FROM "+table+" WHERE id = ?;", testID).Scan(&stored, &keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, si.AdminPassword) || keyID != s.keyring.KeyID() {
+		t.Error("Admin password not encrypted ", stored, keyID)
+	}
+	err = s.db.QueryRow("SELECT password FROM "+bindingTable+" WHERE id = ?;", sb.ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, sb.Password) {
+		t.Error("Binding password stored in plaintext ", stored)
+	}
+	if got, err := s.GetInstance(testID); err != nil || got.AdminPassword != si.AdminPassword {
+		t.Error("Expected decrypted admin password got ", got.AdminPassword, err)
+	}
+	if got, err := s.GetBinding(sb.ID); err != nil || got.Password != sb.Password {
+		t.Error("Expected decrypted binding password got ", got.Password, err)
+	}
+}
+
+func TestSQLiteStoreRotateKeys(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := testKeyring(t)
+	s.SetKeyring(old)
+	err = s.CreateInstance(ServiceInstance{ID: testID, Port: 5432, AdminPassword: "admin-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreateBinding(ServiceBinding{ID: testID, InstanceID: testID, Username: "u1", Password: "secret1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// secrets stored before envelope encryption: admin password sealed
+	// with the state key, binding password in plaintext
+	key, _ := base64.StdEncoding.DecodeString(testStateKey)
+	aead, _ := newAEAD(key)
+	sealed, _ := seal(aead, []byte("legacy-secret"))
+	_, err = s.db.Exec("INSERT INTO "+table+"(id, service, port, info, admin_password) VALUES(?, ?, ?, ?, ?);",
+		inexistentID, "PostgreSQL", 5433, "default", base64.StdEncoding.EncodeToString(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec("INSERT INTO "+bindingTable+"(id, instance_id, username, password) VALUES(?, ?, ?, ?);",
+		inexistentID, inexistentID, "u2", "secret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetKeyring(testKeyring(t, testNewStateKey, testStateKey))
+	rotated, err := s.RotateKeys()
+	if err != nil || rotated != 4 {
+		t.Fatal("Expected 4 rotated secrets got ", rotated, err)
+	}
+	if rotated, err = s.RotateKeys(); err != nil || rotated != 0 {
+		t.Error("Rotation not idempotent, rotated ", rotated, err)
+	}
+
+	// the old key is no longer needed
+	s.SetKeyring(testKeyring(t, testNewStateKey))
+	for id, password := range map[string]string{testID: "admin-secret", inexistentID: "legacy-secret"} {
+		if si, err := s.GetInstance(id); err != nil || si.AdminPassword != password {
+			t.Error("Expected admin password ", password, " got ", si.AdminPassword, err)
+		}
+	}
+	for id, password := range map[string]string{testID: "secret1", inexistentID: "secret2"} {
+		if sb, err := s.GetBinding(id); err != nil || sb.Password != password {
+			t.Error("Expected binding password ", password, " got ", sb.Password, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq" // Blank import registers the postgres driver
+)
+
+const defaultPostgresPort = 5432
+
+// ClusterProvisioner provisions every service instance as a database on a
+// single shared PostgreSQL server. Each database is owned by a generated
+// NOLOGIN role, binding roles are members of it so objects created by any
+// binding belong to the owner and outlive the binding.
+//
+// The configured user must be allowed to create databases and roles.
+type ClusterProvisioner struct {
+	// Host is the address handed out on binding credentials, defaults to
+	// the host of the cluster URL
+	Host string
+	url  *url.URL
+	port int
+	db   *sql.DB
+}
+
+// NewClusterProvisioner connects to the PostgreSQL server identified by a
+// postgres:// URL
+func NewClusterProvisioner(clusterURL string, host string) (*ClusterProvisioner, error) {
+	u, err := url.Parse(clusterURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, errors.New("cluster URL must use the postgres:// scheme")
+	}
+	port := defaultPostgresPort
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if host == "" {
+		host = u.Hostname()
+	}
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterProvisioner{Host: host, url: u, port: port, db: db}, nil
+}
+
+// Create creates the owner role and the database of the instance
+func (p *ClusterProvisioner) Create(si ServiceInstance, plan Plan) error {
+	owner, database := clusterNames(si)
+	// Generated names are hex strings, safe to be embedded in the statements
+	_, err := p.db.Exec("CREATE ROLE " + owner + " NOLOGIN;")
+	if err != nil {
+		return err
+	}
+	// CREATE DATABASE cannot run inside a transaction block
+	_, err = p.db.Exec("CREATE DATABASE " + database + " OWNER " + owner + ";")
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("REVOKE ALL ON DATABASE " + database + " FROM PUBLIC;")
+	return err
+}
+
+// Destroy terminates the connections to the instance's database and drops
+// the database, its owner and the binding roles still left
+func (p *ClusterProvisioner) Destroy(si ServiceInstance) error {
+	owner, database := clusterNames(si)
+	_, err := p.db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity "+
+		"WHERE datname = $1 AND pid <> pg_backend_pid();", database)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("DROP DATABASE IF EXISTS " + database + ";")
+	if err != nil {
+		return err
+	}
+
+	// Binding roles are members of the owner role
+	rows, err := p.db.Query("SELECT m.rolname FROM pg_auth_members a "+
+		"JOIN pg_roles m ON m.oid = a.member JOIN pg_roles o ON o.oid = a.roleid "+
+		"WHERE o.rolname = $1 AND m.rolname <> current_user;", owner)
+	if err != nil {
+		return err
+	}
+	var roles []string
+	for rows.Next() {
+		var role string
+		err = rows.Scan(&role)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		roles = append(roles, role)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		_, err = p.db.Exec("DROP ROLE IF EXISTS " + role + ";")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = p.db.Exec("DROP ROLE IF EXISTS " + owner + ";")
+	return err
+}
+
+// Describe reports the cluster's address and whether the instance's database
+// exists
+func (p *ClusterProvisioner) Describe(si ServiceInstance) (InstanceDetails, error) {
+	_, database := clusterNames(si)
+	var exists bool
+	err := p.db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1);", database).
+		Scan(&exists)
+	if err != nil {
+		return InstanceDetails{}, err
+	}
+	return InstanceDetails{
+		Host:     p.Host,
+		Port:     p.port,
+		Database: database,
+		Running:  exists,
+	}, nil
+}
+
+// Update has nothing to apply, instances on a shared cluster do not own any
+// resources besides their database
+func (p *ClusterProvisioner) Update(si ServiceInstance, plan Plan, logger *slog.Logger) error {
+	return nil
+}
+
+// CreateRole creates a login role member of the database owner, objects
+// created by the role are owned by the database owner
+func (p *ClusterProvisioner) CreateRole(si ServiceInstance, username string, password string) error {
+	owner, database := clusterNames(si)
+	// Generated names and passwords are hex strings, safe to be embedded in
+	// the statements
+	_, err := p.db.Exec("CREATE ROLE " + username + " LOGIN PASSWORD '" + password + "' IN ROLE " + owner + ";")
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("ALTER ROLE " + username + " IN DATABASE " + database + " SET role = '" + owner + "';")
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("GRANT ALL PRIVILEGES ON DATABASE " + database + " TO " + username + ";")
+	return err
+}
+
+// DropRole hands the objects owned by the role over to the database owner
+// and drops the role
+func (p *ClusterProvisioner) DropRole(si ServiceInstance, username string) error {
+	owner, database := clusterNames(si)
+
+	// Ownership is database local, statements must run on the instance's
+	// database
+	err := p.execOnDatabase(database, "REASSIGN OWNED BY "+username+" TO "+owner+"; DROP OWNED BY "+username+";")
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec("DROP ROLE " + username + ";")
+	return err
+}
+
+// Usage queries the size of the instance's database, the connections open
+// to it and the server version
+func (p *ClusterProvisioner) Usage(si ServiceInstance) (InstanceUsage, error) {
+	_, database := clusterNames(si)
+	var u InstanceUsage
+	err := p.db.QueryRow("SELECT pg_database_size($1), "+
+		"(SELECT count(*) FROM pg_stat_activity WHERE datname = $1), current_setting('server_version');",
+		database).Scan(&u.SizeBytes, &u.Connections, &u.Version)
+	return u, err
+}
+
+// RevokeWrite revokes write privileges on the instance's database from the
+// roles and from the database owner, as binding roles act as the owner. The
+// configured user must be a superuser for the owner's privileges to be
+// revoked
+func (p *ClusterProvisioner) RevokeWrite(si ServiceInstance, roles []string) error {
+	owner, database := clusterNames(si)
+	roles = append(append([]string{}, roles...), owner)
+	return p.execOnDatabase(database, revokeWriteStatements(database, roles))
+}
+
+// GrantWrite restores the privileges removed by RevokeWrite
+func (p *ClusterProvisioner) GrantWrite(si ServiceInstance, roles []string) error {
+	owner, database := clusterNames(si)
+	roles = append(append([]string{}, roles...), owner)
+	return p.execOnDatabase(database, grantWriteStatements(database, roles))
+}
+
+// SetAdminPassword does nothing, instances are administered with the
+// credentials of the cluster URL and their owner role cannot log in
+func (p *ClusterProvisioner) SetAdminPassword(si ServiceInstance, password string) error {
+	return nil
+}
+
+// Ping checks a connection to the shared server can be established
+func (p *ClusterProvisioner) Ping() error {
+	return p.db.Ping()
+}
+
+// NeedsPort is false, every instance is served on the port of the shared
+// server
+func (p *ClusterProvisioner) NeedsPort() bool {
+	return false
+}
+
+// execOnDatabase runs statements connected to the provided database
+func (p *ClusterProvisioner) execOnDatabase(database string, statements string) error {
+	db, err := sql.Open("postgres", p.databaseURL(database))
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+	_, err = db.Exec(statements)
+	return err
+}
+
+// databaseURL returns the cluster URL pointing to another database
+func (p *ClusterProvisioner) databaseURL(database string) string {
+	u := *p.url
+	u.Path = "/" + database
+	return u.String()
+}
+
+// clusterNames derives the owner role and database names of an instance
+func clusterNames(si ServiceInstance) (string, string) {
+	id := strings.Replace(si.ID, "-", "", -1)
+	return "o" + id, "d" + id
+}
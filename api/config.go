@@ -0,0 +1,393 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigEnvPrefix prefixes the environment variables overriding settings,
+// BROKER_STATE_DRIVER overrides state_driver
+const ConfigEnvPrefix = "BROKER_"
+
+// PortEnv is the port to listen on assigned by Cloud Foundry to pushed apps,
+// it overrides the port of the configured address
+const PortEnv = "PORT"
+
+// redacted replaces secrets on printed configurations
+const redacted = "REDACTED"
+
+// Duration is a time.Duration written as "1m30s" in configuration files
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as \"1m30s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config holds the broker settings. Each setting is read from the YAML
+// configuration file, then from its BROKER_ environment variable, then from
+// its command-line flag, named after the setting with dashes
+type Config struct {
+	// Address is the host:port the broker listens on
+	Address string `json:"address"`
+	// Key and Cert are the TLS key pair files of the broker
+	Key  string `json:"key"`
+	Cert string `json:"cert"`
+	// Host is handed out to applications on binding credentials
+	Host             string   `json:"host"`
+	Provisioner      string   `json:"provisioner"`
+	DockerSocket     string   `json:"docker_socket"`
+	ClusterURL       string   `json:"cluster_url"`
+	Catalog          string   `json:"catalog"`
+	QuotaInterval    Duration `json:"quota_interval"`
+	AuthFile         string   `json:"auth_file"`
+	AsyncOnly        bool     `json:"async_only"`
+	StateDriver      string   `json:"state_driver"`
+	State            string   `json:"state"`
+	StateKeyFile     string   `json:"state_key_file"`
+	Ports            string   `json:"ports"`
+	Forwarding       string   `json:"forwarding"`
+	DashboardURL     string   `json:"dashboard_url"`
+	DashboardKeyFile string   `json:"dashboard_key_file"`
+	// ShutdownTimeout bounds how long in-flight requests and background
+	// operations are waited for on SIGTERM
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// LogLevel is the lowest level logged: debug, info, warn or error
+	LogLevel string `json:"log_level"`
+}
+
+// ConfigSettings lists the names of the settings in the configuration file
+var ConfigSettings = []string{"address", "key", "cert", "host", "provisioner", "docker_socket",
+	"cluster_url", "catalog", "quota_interval", "auth_file", "async_only", "state_driver", "state",
+	"state_key_file", "ports", "forwarding", "dashboard_url", "dashboard_key_file",
+	"shutdown_timeout", "log_level"}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Address:         ":8080",
+		Provisioner:     ProvisionerDocker,
+		DockerSocket:    DefaultDockerSocket,
+		QuotaInterval:   Duration(time.Minute),
+		StateDriver:     StoreSQLite,
+		State:           "./foo.db",
+		Ports:           DefaultPortRange.String(),
+		Forwarding:      ForwardingDocker,
+		ShutdownTimeout: Duration(30 * time.Second),
+		LogLevel:        "info",
+	}
+}
+
+// LoadConfig reads a YAML configuration file, settings missing from the file
+// keep their default, unknown settings are rejected
+func LoadConfig(path string) (Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	c, err := ParseConfig(b)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// ParseConfig parses the content of a YAML configuration file
+func ParseConfig(b []byte) (Config, error) {
+	c := DefaultConfig()
+	err := yaml.UnmarshalStrict(b, &c)
+	if err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// EnvName returns the environment variable overriding a setting
+func EnvName(setting string) string {
+	return ConfigEnvPrefix + strings.ToUpper(setting)
+}
+
+// FlagName returns the command-line flag overriding a setting
+func FlagName(setting string) string {
+	return strings.Replace(setting, "_", "-", -1)
+}
+
+// ApplyEnv overrides settings with the environment variables returned by
+// getenv, empty variables are ignored. PORT replaces the port of the address
+// unless BROKER_ADDRESS is set
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	if port := getenv(PortEnv); port != "" {
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil {
+			host = ""
+		}
+		c.Address = net.JoinHostPort(host, port)
+	}
+	for _, setting := range ConfigSettings {
+		value := getenv(EnvName(setting))
+		if value == "" {
+			continue
+		}
+		err := c.Set(setting, value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", EnvName(setting), err)
+		}
+	}
+	return nil
+}
+
+// Set assigns the string value of a setting
+func (c *Config) Set(setting, value string) error {
+	var err error
+	switch setting {
+	case "address":
+		c.Address = value
+	case "key":
+		c.Key = value
+	case "cert":
+		c.Cert = value
+	case "host":
+		c.Host = value
+	case "provisioner":
+		c.Provisioner = value
+	case "docker_socket":
+		c.DockerSocket = value
+	case "cluster_url":
+		c.ClusterURL = value
+	case "catalog":
+		c.Catalog = value
+	case "quota_interval":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		c.QuotaInterval = Duration(d)
+	case "shutdown_timeout":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		c.ShutdownTimeout = Duration(d)
+	case "auth_file":
+		c.AuthFile = value
+	case "async_only":
+		c.AsyncOnly, err = strconv.ParseBool(value)
+	case "state_driver":
+		c.StateDriver = value
+	case "state":
+		c.State = value
+	case "state_key_file":
+		c.StateKeyFile = value
+	case "ports":
+		c.Ports = value
+	case "forwarding":
+		c.Forwarding = value
+	case "dashboard_url":
+		c.DashboardURL = value
+	case "dashboard_key_file":
+		c.DashboardKeyFile = value
+	case "log_level":
+		c.LogLevel = value
+	default:
+		return fmt.Errorf("unknown setting %q", setting)
+	}
+	return err
+}
+
+// ConfigError lists every problem of an invalid configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// add records a problem of a setting along with the ways to set it
+func (e *ConfigError) add(setting, format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf("%s: %s (set -%s, %s or %s in the config file)", setting,
+		fmt.Sprintf(format, args...), FlagName(setting), EnvName(setting), setting))
+}
+
+// Validate checks every setting and reports all the problems found at once.
+// serving is false for commands which exit without listening, they need no
+// TLS key pair
+func (c Config) Validate(serving bool) error {
+	var problems ConfigError
+	if serving {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			problems.add("address", "expected host:port or :port, got %q", c.Address)
+		}
+		for _, setting := range []string{"key", "cert"} {
+			if c.file(setting) == "" {
+				problems.add(setting, "required, the broker only serves HTTPS")
+			}
+		}
+	}
+	for _, setting := range []string{"key", "cert", "catalog", "auth_file", "state_key_file",
+		"dashboard_key_file"} {
+		if path := c.file(setting); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems.add(setting, "%v", err)
+			}
+		}
+	}
+	switch c.Provisioner {
+	case ProvisionerDocker:
+		if c.DockerSocket == "" {
+			problems.add("docker_socket", "required by the %q provisioner", c.Provisioner)
+		}
+	case ProvisionerCluster:
+		if c.ClusterURL == "" {
+			problems.add("cluster_url", "required by the %q provisioner", c.Provisioner)
+		}
+	case ProvisionerMemory:
+	default:
+		problems.add("provisioner", "expected %q, %q or %q, got %q", ProvisionerDocker,
+			ProvisionerCluster, ProvisionerMemory, c.Provisioner)
+	}
+	if c.QuotaInterval < 0 {
+		problems.add("quota_interval", "must not be negative, 0 disables quota enforcement")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems.add("shutdown_timeout", "must be positive, such as 30s")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problems.add("log_level", "expected debug, info, warn or error, got %q", c.LogLevel)
+	}
+	switch c.StateDriver {
+	case StoreSQLite, StorePostgres:
+	default:
+		problems.add("state_driver", "expected %q or %q, got %q", StoreSQLite, StorePostgres,
+			c.StateDriver)
+	}
+	if c.State == "" {
+		problems.add("state", "required, the sqlite file or postgres URL of the state database")
+	}
+	if _, err := ParsePortRange(c.Ports); err != nil {
+		problems.add("ports", "%v", err)
+	}
+	switch c.Forwarding {
+	case ForwardingDocker, ForwardingIPTables, ForwardingNone:
+	default:
+		problems.add("forwarding", "expected %q, %q or %q, got %q", ForwardingDocker,
+			ForwardingIPTables, ForwardingNone, c.Forwarding)
+	}
+	if c.DashboardURL != "" {
+		u, err := url.Parse(c.DashboardURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems.add("dashboard_url", "expected an absolute http(s) URL, got %q", c.DashboardURL)
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// file returns the path held by a file setting
+func (c Config) file(setting string) string {
+	switch setting {
+	case "key":
+		return c.Key
+	case "cert":
+		return c.Cert
+	case "catalog":
+		return c.Catalog
+	case "auth_file":
+		return c.AuthFile
+	case "state_key_file":
+		return c.StateKeyFile
+	case "dashboard_key_file":
+		return c.DashboardKeyFile
+	}
+	return ""
+}
+
+// Redacted returns the config with the passwords of its database URLs and
+// connection strings replaced, the key files only hold paths and are kept
+func (c Config) Redacted() Config {
+	c.ClusterURL = redactURL(c.ClusterURL)
+	c.State = redactURL(c.State)
+	return c
+}
+
+// dsnPassword matches the password of a key/value connection string, such as
+// "host=db password='secret'", quoted values may hold escaped quotes
+var dsnPassword = regexp.MustCompile(`(^|\s)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactURL hides the password of a database URL, in its user info or in a
+// password query parameter, or of a key/value connection string as both are
+// accepted by lib/pq. Values without a password, such as sqlite files, are
+// returned as is
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return dsnPassword.ReplaceAllString(s, "${1}${2}"+redacted)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// The password cannot be told apart from the rest of the value
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if q := u.Query(); q.Get("password") != "" {
+		q.Set("password", redacted)
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// YAML returns the config as a configuration file
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// ProvisionerConfig returns the settings of the provisioner backend
+func (c Config) ProvisionerConfig() ProvisionerConfig {
+	return ProvisionerConfig{
+		Name:         c.Provisioner,
+		Host:         c.Host,
+		DockerSocket: c.DockerSocket,
+		ClusterURL:   c.ClusterURL,
+		Forwarding:   c.Forwarding,
+	}
+}
@@ -0,0 +1,114 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	c, err := ParseConfig([]byte("address: 127.0.0.1:9000\nstate: /var/lib/broker.db\n" +
+		"quota_interval: 5m\nasync_only: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Provisioner != ProvisionerDocker || c.QuotaInterval != Duration(5*time.Minute) || !c.AsyncOnly {
+		t.Error("Config file not merged with the defaults ", c)
+	}
+	env := map[string]string{"PORT": "61000", "BROKER_STATE_DRIVER": "postgres",
+		"BROKER_STATE": "postgres://broker:secret@db:5432/broker"}
+	err = c.ApplyEnv(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address != "127.0.0.1:61000" || c.StateDriver != StorePostgres {
+		t.Error("Environment not applied ", c)
+	}
+	if err = c.Set("quota_interval", "0s"); err != nil || c.QuotaInterval != 0 {
+		t.Error("Setting not set ", err, c.QuotaInterval)
+	}
+
+	out, err := c.Redacted().YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "secret") || !strings.Contains(string(out), "broker:REDACTED@db") {
+		t.Error("Secrets not redacted ", string(out))
+	}
+	if c.State != "postgres://broker:secret@db:5432/broker" {
+		t.Error("Redacted modified the config ", c.State)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	tests := []struct {
+		value    string
+		redacted string
+	}{
+		{"./foo.db", "./foo.db"},
+		{"postgres://broker:secret@db/broker?sslmode=disable",
+			"postgres://broker:REDACTED@db/broker?sslmode=disable"},
+		{"host=db password=secret dbname=broker", "host=db password=REDACTED dbname=broker"},
+		{"host=db password = 'se cr\\'et' sslmode=disable", "host=db password = REDACTED sslmode=disable"},
+		{"password=secret", "password=REDACTED"},
+	}
+	for _, test := range tests {
+		c := Config{State: test.value, ClusterURL: test.value}.Redacted()
+		if c.State != test.redacted || c.ClusterURL != test.redacted {
+			t.Errorf("%q redacted as %q, expected %q", test.value, c.State, test.redacted)
+		}
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	if _, err := ParseConfig([]byte("stat: ./broker.db\n")); err == nil {
+		t.Error("Unknown setting accepted")
+	}
+	if _, err := ParseConfig([]byte("quota_interval: 60\n")); err == nil {
+		t.Error("Duration without unit accepted")
+	}
+	c := DefaultConfig()
+	if err := c.ApplyEnv(func(name string) string {
+		if name == "BROKER_ASYNC_ONLY" {
+			return "maybe"
+		}
+		return ""
+	}); err == nil || !strings.Contains(err.Error(), "BROKER_ASYNC_ONLY") {
+		t.Error("Invalid environment variable not reported ", err)
+	}
+
+	c = DefaultConfig()
+	if err := c.Validate(false); err != nil {
+		t.Error("Default config rejected ", err)
+	}
+	c.Provisioner = ProvisionerCluster
+	c.Ports = "7000-6000"
+	c.Catalog = "missing.yml"
+	err := c.Validate(true)
+	problems, ok := err.(ConfigError)
+	if !ok || len(problems) != 5 {
+		t.Fatal("Unexpected problems ", err)
+	}
+	for _, problem := range []string{"key: required", "cert: required", "cluster_url: required",
+		"ports:", "catalog:", "-cluster-url, BROKER_CLUSTER_URL"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Problem %q not reported on %v", problem, err)
+		}
+	}
+}
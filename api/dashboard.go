@@ -0,0 +1,215 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DashboardKeyEnv is the environment variable holding the dashboard signing
+// key when no key file is configured
+const DashboardKeyEnv = "BROKER_DASHBOARD_KEY"
+
+// dashboardKeyBytes is the minimum size of dashboard signing keys
+const dashboardKeyBytes = 32
+
+// Instance states shown on the dashboard
+const (
+	dashboardRunning      = "running"
+	dashboardStopped      = "stopped"
+	dashboardProvisioning = "provisioning"
+)
+
+var errDashboardForbidden = &BrokerError{
+	Status:      http.StatusForbidden,
+	Description: "A valid dashboard token is required",
+}
+
+// ParseDashboardKey decodes a base64 encoded dashboard signing key
+func ParseDashboardKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("dashboard key must be base64 encoded: %v", err)
+	}
+	if len(key) < dashboardKeyBytes {
+		return nil, fmt.Errorf("dashboard key must be at least %d bytes, got %d", dashboardKeyBytes, len(key))
+	}
+	return key, nil
+}
+
+// LoadDashboardKey reads a base64 encoded dashboard signing key from a file
+func LoadDashboardKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDashboardKey(string(b))
+}
+
+// DashboardStatus is the state of an instance shown on its dashboard
+type DashboardStatus struct {
+	InstanceID    string `json:"instance_id"`
+	Status        string `json:"status"`
+	Plan          string `json:"plan"`
+	SizeBytes     int64  `json:"size_bytes"`
+	QuotaBytes    int64  `json:"quota_bytes,omitempty"`
+	QuotaExceeded bool   `json:"quota_exceeded"`
+	Connections   int    `json:"connections"`
+	Version       string `json:"version,omitempty"`
+}
+
+// dashboardTemplate renders a DashboardStatus
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>PostgreSQL {{.InstanceID}}</title></head>
+<body>
+<h1>PostgreSQL service instance</h1>
+<table>
+<tr><th>Instance</th><td>{{.InstanceID}}</td></tr>
+<tr><th>Status</th><td>{{.Status}}</td></tr>
+<tr><th>Plan</th><td>{{.Plan}}</td></tr>
+<tr><th>Size</th><td>{{.SizeBytes}} bytes{{if .QuotaBytes}} of {{.QuotaBytes}}{{end}}{{if .QuotaExceeded}}, quota exceeded{{end}}</td></tr>
+<tr><th>Connections</th><td>{{.Connections}}</td></tr>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// dashboardURL returns the URL of the instance's dashboard, empty when no
+// external URL is configured
+func (h *DbHandler) dashboardURL(si ServiceInstance) string {
+	if h.DashboardURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(h.DashboardURL, "/") + "/dashboard/" + si.ID +
+		"?" + url.Values{"token": {h.dashboardToken(si.ID)}}.Encode()
+}
+
+// dashboardToken signs the instance ID, the token grants access to the
+// instance's dashboard only
+func (h *DbHandler) dashboardToken(instance string) string {
+	mac := hmac.New(sha256.New, h.DashboardKey)
+	mac.Write([]byte("dashboard:" + instance))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validDashboardToken reports whether token was issued for the instance
+func (h *DbHandler) validDashboardToken(instance string, token string) bool {
+	if len(h.DashboardKey) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(h.dashboardToken(instance)))
+}
+
+// Dashboard serves the state of an instance as HTML, or as JSON when
+// requested with format=json or an application/json Accept header. Access
+// requires the token of the instance's dashboard URL
+// vars [id]
+// Query params:
+// token* - string
+// format - string
+func (h *DbHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	logger := h.requestLogger(r).With("instance_id", id)
+	if !h.validDashboardToken(id, r.URL.Query().Get("token")) {
+		respondError(w, errDashboardForbidden)
+		return
+	}
+
+	si, err := h.Store.GetInstance(id)
+	if err == ErrInstanceNotFound {
+		respondError(w, errNoSuchInstance)
+		return
+	}
+	if err != nil {
+		logger.Error("reading the instance failed", "error", err)
+		respondError(w, NewInternalError(err))
+		return
+	}
+	status, err := h.dashboardStatus(si)
+	if err != nil {
+		logger.Error("reading the instance status failed", "error", err)
+		respondError(w, NewInternalError(err))
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(status)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = dashboardTemplate.Execute(w, status)
+	}
+	if err != nil {
+		logger.Warn("writing the response failed", "error", err)
+	}
+}
+
+// dashboardStatus gathers the state of the instance from the store and the
+// provisioner, usage is only measured on running instances
+func (h *DbHandler) dashboardStatus(si ServiceInstance) (DashboardStatus, error) {
+	status := DashboardStatus{
+		InstanceID:    si.ID,
+		Plan:          si.PlanID,
+		QuotaExceeded: si.QuotaExceeded,
+	}
+	if plan, ok := h.findPlan(si.PlanID); ok {
+		status.Plan = plan.Name
+		status.QuotaBytes = plan.Limits.StorageMB * bytesPerMB
+	}
+
+	op, err := h.Store.GetOperation(si.ID, "")
+	if err == nil && op.Type == OperationProvision && op.State == OperationInProgress {
+		status.Status = dashboardProvisioning
+		return status, nil
+	}
+	if err != nil && err != ErrOperationNotFound {
+		return DashboardStatus{}, err
+	}
+
+	d, err := h.Provisioner.Describe(si)
+	if err != nil {
+		return DashboardStatus{}, err
+	}
+	if !d.Running {
+		status.Status = dashboardStopped
+		return status, nil
+	}
+	status.Status = dashboardRunning
+	usage, err := h.Provisioner.Usage(si)
+	if err != nil {
+		return DashboardStatus{}, err
+	}
+	status.SizeBytes = usage.SizeBytes
+	status.Connections = usage.Connections
+	status.Version = usage.Version
+	return status, nil
+}
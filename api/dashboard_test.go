@@ -0,0 +1,112 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDashboard(t *testing.T) {
+	const planID = "83c8811b-f3db-17ef-6eb3-bbe944b47262" // 5mb plan
+	key, err := ParseDashboardKey(testStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisioner := NewMemoryProvisioner()
+	dbhandler := DbHandler{
+		Store:        NewMemoryStore(),
+		Provisioner:  provisioner,
+		DashboardURL: "https://broker.example.com/",
+		DashboardKey: key,
+	}
+	si, err := dbhandler.Add(testID, ProvisionRequest{PlanID: planID}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisioner.SetSize(testID, 2*bytesPerMB)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/dashboard/{id}", dbhandler.Dashboard).Methods("GET")
+	serve := func(uri string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	u, err := url.Parse(dbhandler.dashboardURL(si))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "broker.example.com" || u.Path != "/dashboard/"+testID || u.Query().Get("token") == "" {
+		t.Fatal("Unexpected dashboard URL ", u)
+	}
+
+	rr := serve(u.RequestURI() + "&format=json")
+	if rr.Code != http.StatusOK {
+		t.Fatal("Dashboard: expected status 200 got ", rr.Code)
+	}
+	var status DashboardStatus
+	err = json.NewDecoder(rr.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != dashboardRunning || status.Plan != "5mb" || status.SizeBytes != 2*bytesPerMB ||
+		status.QuotaBytes != 5*bytesPerMB || status.Version != memoryVersion {
+		t.Error("Dashboard: unexpected status ", status)
+	}
+
+	rr = serve(u.RequestURI())
+	if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || !strings.HasPrefix(ct, "text/html") {
+		t.Error("Dashboard: expected HTML page got ", rr.Code, ct)
+	}
+	if !strings.Contains(rr.Body.String(), "5mb") {
+		t.Error("Dashboard: plan not shown on the page")
+	}
+
+	// tokens grant access to their instance only
+	if rr := serve("/dashboard/" + testID + "?token=invalid"); rr.Code != http.StatusForbidden {
+		t.Error("Dashboard with invalid token: expected status 403 got ", rr.Code)
+	}
+	other := "/dashboard/" + inexistentID + "?token=" + u.Query().Get("token")
+	if rr := serve(other); rr.Code != http.StatusForbidden {
+		t.Error("Dashboard with the token of another instance: expected status 403 got ", rr.Code)
+	}
+	unknown := "/dashboard/" + inexistentID + "?token=" + dbhandler.dashboardToken(inexistentID)
+	if rr := serve(unknown); rr.Code != http.StatusNotFound {
+		t.Error("Dashboard of unknown instance: expected status 404 got ", rr.Code)
+	}
+
+	// without external URL no dashboard is handed out
+	dbhandler.DashboardURL = ""
+	if d := dbhandler.dashboardURL(si); d != "" {
+		t.Error("Dashboard URL handed out without external URL ", d)
+	}
+	if _, err := ParseDashboardKey("c2hvcnQ="); err == nil {
+		t.Error("Short dashboard key accepted")
+	}
+}
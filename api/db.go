@@ -17,177 +17,555 @@
 package api
 
 import (
-	"database/sql"
+	"context"
+	"crypto/x509"
 	"encoding/json"
-	"fmt"
-	"log"
-	"os/exec"
-	"strconv"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3" // Blank import according to go-sqlite3's instructions
+	"github.com/cloudfoundry-community/cf-postgresql-broker/util"
 )
 
 const (
-	table           = "service_instance"
-	defaultUser     = "postgres"
-	defaultPassword = "mysecretpassword"
+	passwordBytes  = 16 // random bytes used for generated passwords
+	operationBytes = 8  // random bytes used for operation IDs
 )
 
-//DbHandler type holds DB connection and basic data
+//DbHandler type holds the broker state and basic data
 type DbHandler struct {
-	Name string
-	Path string
-	Open bool
-	db   *sql.DB
+	// Store keeps the instances, bindings and operations of the broker
+	Store Store
+	// Provisioner is the backend running the service instances
+	Provisioner Provisioner
+	// Services offered on the catalog, the built-in catalog is served when
+	// nil
+	Services []Service
+	// RequireAsync rejects provision, update and deprovision requests which
+	// do not accept asynchronous operations with AsyncRequired
+	RequireAsync bool
+	// Ports allocated to the instances, DefaultPortRange when zero
+	Ports PortRange
+	// Forwarder exposes the ports of instances running on internal
+	// addresses, nil when the provisioner exposes them itself
+	Forwarder PortForwarder
+	// DashboardURL is the external URL the broker is reached at, instance
+	// dashboards are served under it. No dashboard URL is handed out when
+	// empty
+	DashboardURL string
+	// DashboardKey signs the tokens granting access to the dashboards
+	DashboardKey []byte
+	// Certificate is the TLS certificate served by the broker, its validity
+	// is checked by Readyz when set
+	Certificate *x509.Certificate
+	// Metrics records the outcome of operations, nothing is recorded when
+	// nil
+	Metrics *Metrics
+	// Logger writes the structured logs of the handler, slog.Default() when
+	// nil
+	Logger *slog.Logger
+
+	// jobs tracks the asynchronous operations running in background, by
+	// operation ID, so they can be drained on shutdown
+	jobs     sync.WaitGroup
+	jobMutex sync.Mutex
+	running  map[string]Operation
 }
 
-// Remove service registry from database
-func (h *DbHandler) Remove(instance string) (int, error) {
-	var err error
+// interruptedDescription is recorded on the operations cut short by a
+// shutdown, the platform may retry them
+const interruptedDescription = " interrupted by broker shutdown"
+
+// Drain waits for the asynchronous operations running in background. When ctx
+// is done first the operations still running are recorded as failed, so the
+// platform stops polling them and cleans up or retries, and ctx's error is
+// returned
+func (h *DbHandler) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
 
-	h.db, _ = sql.Open(h.Name, h.Path)
-	defer func() {
-		err = h.db.Close()
+	h.jobMutex.Lock()
+	defer h.jobMutex.Unlock()
+	for _, op := range h.running {
+		logger := h.logger().With("instance_id", op.InstanceID, "operation_id", op.ID, "operation", op.Type)
+		logger.Warn("operation interrupted by shutdown")
+		err := h.Store.UpdateOperation(op.ID, OperationFailed, op.Type+interruptedDescription)
 		if err != nil {
-			log.Print(err.Error())
+			logger.Error("recording the interrupted operation failed", "error", err)
 		}
-	}()
+	}
+	return ctx.Err()
+}
 
-	// delete docker container
-	cmd := exec.Command("docker", "stop", instance)
-	err = cmd.Run()
-	cmd = exec.Command("docker", "rm", instance)
-	err = cmd.Run()
+// Remove service registry from the store and destroy the instance, returns
+// false if the instance does not exist
+func (h *DbHandler) Remove(instance string) (bool, error) {
+	si, err := h.Store.GetInstance(instance)
+	if err == ErrInstanceNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	// delete from database
-	deleteQuery := "DELETE FROM " + table + " WHERE " + table + ".id = '" + instance + "'"
-	res, err := h.db.Exec(deleteQuery)
-	rows, _ := res.RowsAffected()
+	started := time.Now()
+	err = h.Provisioner.Destroy(si)
+	if err == nil {
+		err = h.unforward(instance)
+	}
+	h.Metrics.observeOperation(OperationDeprovision, si.PlanID, started, err)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	return int(rows), nil
+	// bindings and forward rule are gone along with the instance
+	return h.Store.DeleteInstance(instance)
 }
 
-// Add service registry into database
-func (h *DbHandler) Add(instance string, pr ProvisionRequest) (ServiceInstance, error) {
-	var err error
-	var rows *sql.Rows
-
-	h.db, _ = sql.Open(h.Name, h.Path)
-	defer func() {
-		e := h.db.Close()
-		if e != nil {
-			log.Print(e.Error())
-		}
-	}()
-
-	// Get the Server port to use
-	rows, err = h.db.Query("SELECT MAX(port) FROM " + table + " WHERE port IS NOT NULL;")
-
+// Add service registry into the store and create the instance, logger is the
+// logger of the request provisioning the instance
+func (h *DbHandler) Add(instance string, pr ProvisionRequest, logger *slog.Logger) (ServiceInstance, error) {
+	si, err := h.Register(instance, pr, logger)
 	if err != nil {
 		return ServiceInstance{}, err
 	}
-	rows.Next()
-
-	// Will scan port into empty interface, this allows for nil checks in case
-	// table is empty
-	var portScan interface{}
-	var port int
-	err = rows.Scan(&portScan)
+	err = h.Start(si)
 	if err != nil {
+		if e := h.Discard(si, logger); e != nil {
+			logger.Error("forgetting the failed instance failed", "error", e)
+		}
 		return ServiceInstance{}, err
 	}
-	if portScan == nil {
-		port = 0
-	} else {
-		port = int(portScan.(int64))
+	// The provision is recorded so that it supersedes a failed asynchronous
+	// provision of the same instance
+	op, err := newOperation(instance, OperationProvision)
+	if err == nil {
+		op.State = OperationSucceeded
+		op.Description = OperationProvision + " succeeded"
+		err = h.Store.CreateOperation(op)
 	}
-	if port == 0 {
-		port = 5432
-	} else {
-		port = port + 1
+	if err != nil {
+		logger.Error("recording the provision failed", "error", err)
 	}
+	return si, nil
+}
 
-	err = rows.Close()
-	if err != nil {
-		log.Print(err.Error())
+// Discard removes what was created for an instance whose provision failed
+// and forgets the instance so that the platform can retry the provision, the
+// operations of the instance are kept to report the failure
+func (h *DbHandler) Discard(si ServiceInstance, logger *slog.Logger) error {
+	if e := h.Provisioner.Destroy(si); e != nil {
+		logger.Error("destroying the failed instance failed", "error", e)
+	}
+	if e := h.unforward(si.ID); e != nil {
+		logger.Error("removing the forward rule of the failed instance failed", "error", e)
+	}
+	_, err := h.Store.DeleteInstance(si.ID)
+	return err
+}
+
+// Start creates a registered instance on the provisioner applying the
+// limits of its plan and forwards its port
+func (h *DbHandler) Start(si ServiceInstance) error {
+	plan, _ := h.findPlan(si.PlanID)
+	started := time.Now()
+	err := h.Provisioner.Create(si, plan)
+	if err == nil {
+		err = h.forward(si)
 	}
-	insertQuery := "INSERT INTO " + table + "(id, service, port, info) " +
-		"VALUES('" + instance + "','" + "psql'," + strconv.Itoa(port) + ",'example');"
+	h.Metrics.observeOperation(OperationProvision, si.PlanID, started, err)
+	return err
+}
 
-	_, err = h.db.Exec(insertQuery)
+// Register adds the service registry into the store reserving a port for the
+// instance, the instance is not created on the provisioner
+func (h *DbHandler) Register(instance string, pr ProvisionRequest, logger *slog.Logger) (ServiceInstance, error) {
+	// Every instance gets its own superuser password
+	adminPassword, err := util.GenerateRandomString(passwordBytes)
 	if err != nil {
 		return ServiceInstance{}, err
 	}
 
+	// Get the Server port to use, ports of deleted instances are reused.
+	// Instances of provisioners serving them on a shared port get none
+	port := 0
+	if h.Provisioner.NeedsPort() {
+		port, err = h.Store.AllocatePort(instance, h.portRange())
+		if err != nil {
+			return ServiceInstance{}, err
+		}
+	}
+
 	si := ServiceInstance{}
 	si.ID = instance
+	si.AdminPassword = adminPassword
 	si.Info = "default"
 	si.Port = port
 	si.Service = "PostgreSQL"
-
-	cmd := exec.Command("docker", "run", "--name", si.ID,
-		"-e", "POSTGRES_PASSWORD="+defaultPassword,
-		"-e", "POSTGRES_USER="+defaultUser,
-		"-P", // assigns free port automatically
-		"-d", "postgres")
-	errCmd := cmd.Run()
-	if errCmd != nil {
-		log.Fatal(errCmd)
-	}
-	// Docker inspect
-	cmd = exec.Command("docker", "inspect", si.ID)
-	stdout, _ := cmd.StdoutPipe()
-	//reader := bufio.NewScanner(stdout)
-
-	errCmd = cmd.Start()
-	if errCmd != nil {
-		log.Fatal(errCmd)
-	}
-
-	fmt.Println("docker executed:")
-	//for reader.Scan() {
-	//	fmt.Println(reader.Text())
-	//}
-	decoder := json.NewDecoder(stdout)
-	var inspect []interface{}
-	err = decoder.Decode(&inspect)
+	si.PlanID = pr.PlanID
+	si.ServiceID = pr.ServiceID
+	si.OrganizationGUID = pr.OrganizationGUID
+	si.SpaceGUID = pr.SpaceGUID
+	si.Parameters, err = encodeParameters(pr.Parameters)
+	if err == nil {
+		err = h.Store.CreateInstance(si)
+	}
 	if err != nil {
+		h.releasePort(port, logger)
 		return ServiceInstance{}, err
 	}
-	if ew := cmd.Wait(); ew != nil {
-		log.Fatal(ew)
+	return si, nil
+}
+
+// releasePort frees the port of an instance which could not be registered,
+// instances registered without a port have none to release
+func (h *DbHandler) releasePort(port int, logger *slog.Logger) {
+	if port == 0 {
+		return
 	}
-	// iptables
-	object := inspect[0]
-	network := object.(map[string]interface{})["NetworkSettings"]
-	ip := network.(map[string]interface{})["IPAddress"]
-	fmt.Println(ip.(string))
+	e := h.Store.ReleasePort(port)
+	if e != nil {
+		logger.Error("releasing the port failed", "port", port, "error", e)
+	}
+}
 
-	cmd = exec.Command("iptables", "-t", "nat", "-A", "DOCKER", "-p", "tcp", "--dport", strconv.Itoa(si.Port), "-j",
-		"DNAT", "--to-destination", ip.(string)+":5432")
-	_ = cmd.Run()
-	return si, nil
+// portRange returns the ports allocated to the instances
+func (h *DbHandler) portRange() PortRange {
+	if h.Ports == (PortRange{}) {
+		return DefaultPortRange
+	}
+	return h.Ports
+}
+
+// ChangePlan applies the limits of the provided plan to the instance and
+// records the new plan in the store, logger is the logger of the request
+// changing the plan
+func (h *DbHandler) ChangePlan(instance string, plan Plan, logger *slog.Logger) error {
+	err := h.Store.ModifyInstance(instance, func(si *ServiceInstance) error {
+		started := time.Now()
+		err := h.Provisioner.Update(*si, plan, logger)
+		h.Metrics.observeOperation(OperationUpdate, plan.ID, started, err)
+		if err != nil {
+			return err
+		}
+		si.PlanID = plan.ID
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Updates may restart the instance on a new address
+	si, err := h.Store.GetInstance(instance)
+	if err != nil {
+		return err
+	}
+	return h.forward(si)
+}
+
+// forward records the forward rule of the instance's port and applies it,
+// a previous rule pointing to another address is removed
+func (h *DbHandler) forward(si ServiceInstance) error {
+	if h.Forwarder == nil || !h.Provisioner.NeedsPort() {
+		return nil
+	}
+	d, err := h.Provisioner.Describe(si)
+	if err != nil {
+		return err
+	}
+	if d.Target == "" {
+		return nil // reachable without forwarding
+	}
+	rule := ForwardRule{InstanceID: si.ID, Port: si.Port, Target: d.Target}
+
+	previous, err := h.Store.GetForwardRule(si.ID)
+	if err != nil && err != ErrForwardRuleNotFound {
+		return err
+	}
+	err = h.Store.SaveForwardRule(rule)
+	if err != nil {
+		return err
+	}
+	if previous != (ForwardRule{}) && previous != rule {
+		err = h.Forwarder.Remove(previous)
+		if err != nil {
+			return err
+		}
+	}
+	return h.Forwarder.Add(rule)
 }
 
-//Setup sqlite database
-func (h *DbHandler) Setup() {
-	h.db, _ = sql.Open(h.Name, h.Path)
-	d := h.db
+// unforward removes the forward rule of the instance's port, the rule is
+// deleted from the store along with the instance
+func (h *DbHandler) unforward(instance string) error {
+	if h.Forwarder == nil || !h.Provisioner.NeedsPort() {
+		return nil
+	}
+	rule, err := h.Store.GetForwardRule(instance)
+	if err == ErrForwardRuleNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return h.Forwarder.Remove(rule)
+}
+
+// SyncForwarding refreshes the forward rules of running instances, whose
+// address may have changed while the broker was down, and replaces the rules
+// applied by the forwarder with the rules of the store. It is meant to run at
+// startup
+func (h *DbHandler) SyncForwarding() error {
+	if h.Forwarder == nil {
+		return nil
+	}
+	instances, err := h.Store.ListInstances()
+	if err != nil {
+		return err
+	}
+	for _, si := range instances {
+		d, err := h.Provisioner.Describe(si)
+		if err != nil {
+			// Keep the last known rule of the instance
+			h.logger().Warn("describing the instance for port forwarding failed", "instance_id", si.ID,
+				"error", err)
+			continue
+		}
+		if d.Target == "" {
+			continue
+		}
+		err = h.Store.SaveForwardRule(ForwardRule{InstanceID: si.ID, Port: si.Port, Target: d.Target})
+		if err != nil {
+			return err
+		}
+	}
+	rules, err := h.Store.ListForwardRules()
+	if err != nil {
+		return err
+	}
+	return h.Forwarder.Sync(rules)
+}
+
+// GenerateAdminPasswords replaces the shared superuser password of instances
+// provisioned before passwords were generated per instance. It is meant to
+// run at startup
+func (h *DbHandler) GenerateAdminPasswords() error {
+	instances, err := h.Store.ListInstances()
+	if err != nil {
+		return err
+	}
+	for _, si := range instances {
+		if si.AdminPassword != "" {
+			continue
+		}
+		password, err := util.GenerateRandomString(passwordBytes)
+		if err != nil {
+			return err
+		}
+		err = h.Store.ModifyInstance(si.ID, func(si *ServiceInstance) error {
+			if si.AdminPassword != "" {
+				return nil // changed by another broker
+			}
+			err := h.Provisioner.SetAdminPassword(*si, password)
+			if err != nil {
+				return err
+			}
+			si.AdminPassword = password
+			return nil
+		})
+		if err != nil {
+			// A stopped instance must not prevent the others from changing
+			h.logger().Warn("generating the admin password failed", "instance_id", si.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// ErrOperationInProgress is returned when an operation of an instance is
+// started while another one is in progress
+var ErrOperationInProgress = errors.New("another operation is in progress")
+
+// StartOperation registers a new operation in progress for the instance,
+// unless another one is in progress. The check and the registration are made
+// under the instance lock, so concurrent requests and brokers sharing the
+// store cannot both start an operation. Returns ErrInstanceNotFound if the
+// instance does not exist
+func (h *DbHandler) StartOperation(instance string, opType string) (Operation, error) {
+	var op Operation
+	err := h.Store.ModifyInstance(instance, func(si *ServiceInstance) error {
+		err := h.checkOperation(instance)
+		if err != nil {
+			return err
+		}
+		op, err = h.AddOperation(instance, opType)
+		return err
+	})
+	return op, err
+}
+
+// checkOperation returns ErrOperationInProgress while an operation of the
+// instance is in progress, it is called under the instance lock
+func (h *DbHandler) checkOperation(instance string) error {
+	op, err := h.Store.GetOperation(instance, "")
+	switch {
+	case err == ErrOperationNotFound:
+		return nil
+	case err != nil:
+		return err
+	case op.State == OperationInProgress:
+		return ErrOperationInProgress
+	}
+	return nil
+}
+
+// AddOperation registers a new asynchronous operation in progress for the
+// instance, the returned operation ID is handed to the platform for polling
+func (h *DbHandler) AddOperation(instance string, opType string) (Operation, error) {
+	op, err := newOperation(instance, opType)
+	if err != nil {
+		return Operation{}, err
+	}
+	err = h.Store.CreateOperation(op)
+	if err != nil {
+		return Operation{}, err
+	}
+	return op, nil
+}
+
+// newOperation returns an operation in progress for the instance with a new
+// random ID
+func newOperation(instance string, opType string) (Operation, error) {
+	id, err := util.GenerateRandomString(operationBytes)
+	if err != nil {
+		return Operation{}, err
+	}
+	return Operation{
+		ID:          id,
+		InstanceID:  instance,
+		Type:        opType,
+		State:       OperationInProgress,
+		Description: opType + " in progress",
+	}, nil
+}
+
+// AddBinding creates a dedicated PostgreSQL role for the binding on the
+// instance and registers the binding into the store, logger is the logger of
+// the request. Returns ErrOperationInProgress while an operation of the
+// instance is in progress
+func (h *DbHandler) AddBinding(instance string, binding string, br BindRequest,
+	logger *slog.Logger) (ServiceBinding, error) {
 	var err error
-	createTableQuery := "CREATE TABLE IF NOT EXISTS " + table +
-		"(id TEXT, " +
-		"service TEXT, " +
-		"port INTEGER, " +
-		"info TEXT);"
-	_, err = d.Exec(createTableQuery)
+	sb := ServiceBinding{ID: binding, InstanceID: instance}
+	sb.Parameters, err = encodeParameters(br.Parameters)
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+	sb.Username = roleName(binding)
+	sb.Password, err = util.GenerateRandomString(passwordBytes)
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+
+	// The quota state is read under the instance lock, so the quota monitor
+	// cannot restore write privileges before the new role is recorded
+	err = h.Store.ModifyInstance(instance, func(si *ServiceInstance) error {
+		err := h.checkOperation(instance)
+		if err != nil {
+			return err
+		}
+		started := time.Now()
+		err = h.Provisioner.CreateRole(*si, sb.Username, sb.Password)
+		h.Metrics.observeOperation(operationBind, si.PlanID, started, err)
+		if err != nil {
+			return err
+		}
+		// Roles bound while the instance is over quota start read only
+		if si.QuotaExceeded {
+			err = h.Provisioner.RevokeWrite(*si, []string{sb.Username})
+		}
+		if err == nil {
+			err = h.Store.CreateBinding(sb)
+		}
+		if err != nil {
+			// A role without binding would never be dropped
+			if e := h.Provisioner.DropRole(*si, sb.Username); e != nil {
+				logger.Error("dropping the role of the failed binding failed", "error", e)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+	return sb, nil
+}
+
+// RemoveBinding drops the binding's role from the instance and deletes the
+// binding registry from the store, returns false if the binding does not
+// exist on the instance
+func (h *DbHandler) RemoveBinding(instance string, binding string) (bool, error) {
+	sb, err := h.Store.GetBinding(binding)
+	if err == ErrBindingNotFound || (err == nil && sb.InstanceID != instance) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Bindings are not removed while an operation of the instance is in
+	// progress
+	removed := false
+	err = h.Store.ModifyInstance(instance, func(si *ServiceInstance) error {
+		err := h.checkOperation(instance)
+		if err != nil {
+			return err
+		}
+		err = h.Provisioner.DropRole(*si, sb.Username)
+		if err != nil {
+			return err
+		}
+		removed, err = h.Store.DeleteBinding(binding)
+		return err
+	})
+	return removed, err
+}
+
+// BindingRoles retrieves the roles of the instance's bindings
+func (h *DbHandler) BindingRoles(instance string) ([]string, error) {
+	bindings, err := h.Store.ListBindings(instance)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = d.Close()
+	var roles []string
+	for _, sb := range bindings {
+		roles = append(roles, sb.Username)
+	}
+	return roles, nil
+}
+
+// encodeParameters encodes the parameters of a request as recorded in the
+// store, no parameters are recorded as empty
+func encodeParameters(parameters interface{}) (string, error) {
+	if parameters == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(parameters)
 	if err != nil {
-		//Unavailability to setup sqlite Db suggest failure
-		panic(err)
+		return "", err
 	}
+	return string(b), nil
+}
+
+// roleName derives a valid PostgreSQL identifier from a binding ID
+func roleName(binding string) string {
+	return "u" + strings.Replace(binding, "-", "", -1)
 }
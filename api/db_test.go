@@ -0,0 +1,126 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminPasswords(t *testing.T) {
+	provisioner := NewMemoryProvisioner()
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: provisioner}
+
+	si, err := dbhandler.Add(testID, ProvisionRequest{}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dbhandler.Add(inexistentID, ProvisionRequest{}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(si.AdminPassword) != 2*passwordBytes || si.AdminPassword == other.AdminPassword {
+		t.Error("Admin passwords not generated per instance ", si.AdminPassword, other.AdminPassword)
+	}
+	if provisioner.AdminPassword(testID) != si.AdminPassword {
+		t.Error("Instance not created with its admin password")
+	}
+
+	// instances provisioned with the shared password get their own
+	si.AdminPassword = ""
+	err = dbhandler.Store.UpdateInstance(si)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbhandler.GenerateAdminPasswords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, err = dbhandler.Store.GetInstance(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.AdminPassword == "" || provisioner.AdminPassword(testID) != si.AdminPassword {
+		t.Error("Admin password not generated for legacy instance ", si.AdminPassword)
+	}
+	if got, _ := dbhandler.Store.GetInstance(inexistentID); got.AdminPassword != other.AdminPassword {
+		t.Error("Admin password of a recent instance replaced")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner()}
+	op, err := dbhandler.AddOperation(testID, OperationProvision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	dbhandler.runOperation(op, dbhandler.logger(), func() error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = dbhandler.Drain(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected the deadline to be exceeded, got ", err)
+	}
+	got, err := dbhandler.Store.GetOperation(testID, op.ID)
+	if err != nil || got.State != OperationFailed || !strings.Contains(got.Description, "shutdown") {
+		t.Error("Interrupted operation not recorded as failed ", got, err)
+	}
+
+	close(release)
+	if err = dbhandler.Drain(context.Background()); err != nil {
+		t.Error("Finished operation not drained ", err)
+	}
+}
+
+// failingBindingStore fails to record bindings while fail is set
+type failingBindingStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failingBindingStore) CreateBinding(sb ServiceBinding) error {
+	if s.fail {
+		return errors.New("recording the binding failed")
+	}
+	return s.MemoryStore.CreateBinding(sb)
+}
+
+// TestAddBindingFailure validates that the role of a binding which could not
+// be recorded is dropped, so that the binding can be retried
+func TestAddBindingFailure(t *testing.T) {
+	const bindingID = "6ab4f79b-6f4c-4b8b-9c1a-1d1f0f1e2a3b"
+	store := &failingBindingStore{MemoryStore: NewMemoryStore(), fail: true}
+	dbhandler := DbHandler{Store: store, Provisioner: NewMemoryProvisioner()}
+	if _, err := dbhandler.Add(testID, ProvisionRequest{}, dbhandler.logger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dbhandler.AddBinding(testID, bindingID, BindRequest{}, dbhandler.logger()); err == nil {
+		t.Fatal("Expected the binding to fail")
+	}
+	store.fail = false
+	if _, err := dbhandler.AddBinding(testID, bindingID, BindRequest{}, dbhandler.logger()); err != nil {
+		t.Error("Retried binding failed ", err)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultUser = "postgres"
+	// legacyPassword is the superuser password of containers created before
+	// passwords were generated per instance
+	legacyPassword  = "mysecretpassword"
+	defaultDatabase = "postgres"
+	postgresImage   = "postgres"
+	postgresPort    = "5432/tcp"
+)
+
+// DockerProvisioner runs every service instance in its own postgres container
+// through the Docker Engine API. The instance's port is either published by
+// the engine or forwarded to the container address reported by Describe
+type DockerProvisioner struct {
+	// Host is the address applications use to reach provisioned instances
+	Host string
+	// PublishPorts has the engine publish the instance's port on the
+	// container, leave it unset when a PortForwarder exposes the instances
+	PublishPorts bool
+	client       *dockerClient
+}
+
+// NewDockerProvisioner returns a provisioner talking to the Docker Engine
+// listening on the provided unix socket
+func NewDockerProvisioner(socket string, host string) *DockerProvisioner {
+	return &DockerProvisioner{Host: host, client: newDockerClient(socket)}
+}
+
+// Create runs the instance's postgres container, publishing the instance's
+// port when PublishPorts is set
+func (p *DockerProvisioner) Create(si ServiceInstance, plan Plan) error {
+	config := containerConfig{
+		Image: postgresImage,
+		Env: []string{
+			"POSTGRES_PASSWORD=" + adminPassword(si),
+			"POSTGRES_USER=" + defaultUser,
+		},
+		ExposedPorts: map[string]struct{}{postgresPort: {}},
+		HostConfig:   createHostConfig{hostConfig: limitResources(plan.Limits)},
+	}
+	if p.PublishPorts {
+		config.HostConfig.PortBindings = map[string][]portBinding{
+			postgresPort: {{HostPort: strconv.Itoa(si.Port)}},
+		}
+	}
+	err := p.client.createContainer(si.ID, config)
+	if err != nil {
+		return err
+	}
+	return p.client.startContainer(si.ID)
+}
+
+// Destroy removes the instance's container, containers already removed are
+// ignored
+func (p *DockerProvisioner) Destroy(si ServiceInstance) error {
+	err := p.client.removeContainer(si.ID)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Describe inspects the instance's container, a missing container is
+// reported as not running. Target is the container address while it runs
+func (p *DockerProvisioner) Describe(si ServiceInstance) (InstanceDetails, error) {
+	d := InstanceDetails{
+		Host:     p.Host,
+		Port:     si.Port,
+		Database: defaultDatabase,
+	}
+	container, err := p.client.inspectContainer(si.ID)
+	if isNotFound(err) {
+		return d, nil
+	}
+	if err != nil {
+		return InstanceDetails{}, err
+	}
+	d.Running = container.State.Running
+	// Containers without an address of their own are not forwarded
+	if ip := container.IPAddress(); d.Running && ip != "" {
+		d.Target = ip + ":" + strconv.Itoa(defaultPostgresPort)
+	}
+	return d, nil
+}
+
+// Ping checks the Docker Engine answers on its socket
+func (p *DockerProvisioner) Ping() error {
+	return p.client.ping()
+}
+
+// NeedsPort is true, the port of every container is published on its
+// allocated port
+func (p *DockerProvisioner) NeedsPort() bool {
+	return true
+}
+
+// Update applies the limits of the plan to the instance's container. The
+// container is restarted when limits cannot be changed while it is running
+func (p *DockerProvisioner) Update(si ServiceInstance, plan Plan, logger *slog.Logger) error {
+	resources := limitResources(plan.Limits)
+	if resources == (hostConfig{}) {
+		// Lift the limits of the previous plan, zero keeps them on update
+		resources = hostConfig{Memory: -1, MemorySwap: -1}
+	}
+	err := p.client.updateContainer(si.ID, resources)
+	if err == nil {
+		return nil
+	}
+
+	// Stopped containers accept any limits, restart to apply them
+	logger.Warn("docker update failed, restarting the container", "error", err)
+	err = p.client.stopContainer(si.ID)
+	if err != nil {
+		return err
+	}
+	errUpdate := p.client.updateContainer(si.ID, resources)
+	err = p.client.startContainer(si.ID)
+	if err != nil {
+		return err
+	}
+	return errUpdate
+}
+
+// SetAdminPassword changes the password of the instance's superuser
+func (p *DockerProvisioner) SetAdminPassword(si ServiceInstance, password string) error {
+	// Generated passwords are hex strings, safe to be embedded in the
+	// statement
+	return p.execPsql(si, "ALTER ROLE "+defaultUser+" PASSWORD '"+password+"';")
+}
+
+// CreateRole creates a login role with all privileges on the instance's
+// database and its public schema, which PostgreSQL 15 and later no longer
+// let every role create objects in
+func (p *DockerProvisioner) CreateRole(si ServiceInstance, username string, password string) error {
+	// Generated names and passwords are hex strings, safe to be embedded in
+	// the statements
+	return p.execPsql(si, "CREATE ROLE "+username+" LOGIN PASSWORD '"+password+"'; "+
+		"GRANT ALL PRIVILEGES ON DATABASE "+defaultDatabase+" TO "+username+"; "+
+		"GRANT USAGE, CREATE ON SCHEMA public TO "+username+";")
+}
+
+// DropRole drops the role, objects created by the application are handed
+// over to the instance's superuser so data outlives the binding
+func (p *DockerProvisioner) DropRole(si ServiceInstance, username string) error {
+	return p.execPsql(si, "REASSIGN OWNED BY "+username+" TO "+defaultUser+"; "+
+		"DROP OWNED BY "+username+"; DROP ROLE "+username+";")
+}
+
+// Usage queries the size of the instance's database, the connections open
+// to it and the server version
+func (p *DockerProvisioner) Usage(si ServiceInstance) (InstanceUsage, error) {
+	out, err := p.queryPsql(si, "SELECT pg_database_size('"+defaultDatabase+"'), "+
+		"(SELECT count(*) FROM pg_stat_activity WHERE datname = '"+defaultDatabase+"'), "+
+		"current_setting('server_version');")
+	if err != nil {
+		return InstanceUsage{}, err
+	}
+	// psql separates unaligned columns with |
+	fields := strings.Split(strings.TrimSpace(string(out)), "|")
+	if len(fields) != 3 {
+		return InstanceUsage{}, fmt.Errorf("unexpected usage %q", out)
+	}
+	var u InstanceUsage
+	u.SizeBytes, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return InstanceUsage{}, fmt.Errorf("unexpected database size %q", fields[0])
+	}
+	u.Connections, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return InstanceUsage{}, fmt.Errorf("unexpected connection count %q", fields[1])
+	}
+	u.Version = fields[2]
+	return u, nil
+}
+
+// RevokeWrite revokes write privileges on the instance's database from the
+// roles
+func (p *DockerProvisioner) RevokeWrite(si ServiceInstance, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	return p.execPsql(si, revokeWriteStatements(defaultDatabase, roles))
+}
+
+// GrantWrite restores write privileges on the instance's database to the
+// roles
+func (p *DockerProvisioner) GrantWrite(si ServiceInstance, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	return p.execPsql(si, grantWriteStatements(defaultDatabase, roles))
+}
+
+// execPsql runs SQL statements inside the instance's container using the psql
+// client shipped with the postgres image
+func (p *DockerProvisioner) execPsql(si ServiceInstance, statements string) error {
+	_, err := p.queryPsql(si, statements)
+	return err
+}
+
+// queryPsql runs SQL statements inside the instance's container and returns
+// the unaligned tuples printed by psql
+func (p *DockerProvisioner) queryPsql(si ServiceInstance, statements string) ([]byte, error) {
+	code, out, err := p.client.exec(si.ID, []string{"psql", "-v", "ON_ERROR_STOP=1", "-q", "-t", "-A",
+		"-U", defaultUser, "-d", defaultDatabase, "-c", statements}, []string{"PGPASSWORD=" + adminPassword(si)})
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("psql on %s exited with code %d: %s", si.ID, code, out)
+	}
+	return out, nil
+}
+
+// adminPassword returns the superuser password of the instance's container
+func adminPassword(si ServiceInstance) string {
+	if si.AdminPassword == "" {
+		return legacyPassword
+	}
+	return si.AdminPassword
+}
+
+// limitResources translates plan limits into container resources, swap is
+// disabled so memory limits hold
+func limitResources(l PlanLimits) hostConfig {
+	var resources hostConfig
+	if l.MemoryMB > 0 {
+		resources.Memory = l.MemoryMB * 1024 * 1024
+		resources.MemorySwap = resources.Memory
+	}
+	return resources
+}
@@ -0,0 +1,283 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DefaultDockerSocket is the unix socket the Docker Engine listens on
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// dockerClient is a minimal Docker Engine API client covering the calls
+// required to manage the instances' containers
+type dockerClient struct {
+	client *http.Client
+	// base is the URL requests are sent to, the host is ignored when
+	// talking through the unix socket
+	base string
+}
+
+// dockerError is returned when the Docker Engine answers with an error status
+type dockerError struct {
+	Status  int
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker engine: %d: %s", e.Status, e.Message)
+}
+
+// isNotFound reports whether err is a docker 404 error
+func isNotFound(err error) bool {
+	e, ok := err.(*dockerError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// containerConfig is the body of a container create request
+type containerConfig struct {
+	Image        string              `json:"Image"`
+	Env          []string            `json:"Env,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   createHostConfig    `json:"HostConfig"`
+}
+
+// hostConfig holds the resources of a container, also used as body of update
+// requests
+type hostConfig struct {
+	Memory     int64 `json:"Memory,omitempty"`
+	MemorySwap int64 `json:"MemorySwap,omitempty"`
+}
+
+// createHostConfig adds the settings only accepted on container creation to
+// hostConfig
+type createHostConfig struct {
+	hostConfig
+	PortBindings map[string][]portBinding `json:"PortBindings,omitempty"`
+}
+
+// portBinding publishes a container port on the host
+type portBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort"`
+}
+
+// newDockerClient returns a client talking to the Docker Engine through the
+// provided unix socket
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{client: &http.Client{Transport: transport}, base: "http://docker"}
+}
+
+// do sends a request to the engine, body is encoded as JSON when not nil. The
+// response is returned for 2xx and 304 status codes, any other status is
+// turned into a dockerError
+func (c *dockerClient) do(method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &dockerError{Status: resp.StatusCode}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(b, e) != nil || e.Message == "" {
+		e.Message = string(b)
+	}
+	return nil, e
+}
+
+// call sends a request and decodes the JSON response into out when not nil
+func (c *dockerClient) call(method string, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ping checks the engine is up
+func (c *dockerClient) ping() error {
+	return c.call("GET", "/_ping", nil, nil, nil)
+}
+
+// createContainer creates a named container, the image is pulled when it is
+// not available on the engine
+func (c *dockerClient) createContainer(name string, config containerConfig) error {
+	query := url.Values{"name": {name}}
+	err := c.call("POST", "/containers/create", query, config, nil)
+	if !isNotFound(err) {
+		return err
+	}
+	err = c.pullImage(config.Image)
+	if err != nil {
+		return err
+	}
+	return c.call("POST", "/containers/create", query, config, nil)
+}
+
+// pullImage pulls an image, the engine streams the progress which is
+// consumed until the pull completes
+func (c *dockerClient) pullImage(image string) error {
+	resp, err := c.do("POST", "/images/create", url.Values{"fromImage": {image}, "tag": {"latest"}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Errors during the pull are reported within the stream
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		err = decoder.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("docker pull %s: %s", image, msg.Error)
+		}
+	}
+}
+
+// startContainer starts a container, starting a running container succeeds
+func (c *dockerClient) startContainer(id string) error {
+	return c.call("POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// stopContainer stops a container, stopping a stopped container succeeds
+func (c *dockerClient) stopContainer(id string) error {
+	return c.call("POST", "/containers/"+id+"/stop", nil, nil, nil)
+}
+
+// removeContainer removes a container and its anonymous volumes, running
+// containers are killed
+func (c *dockerClient) removeContainer(id string) error {
+	return c.call("DELETE", "/containers/"+id, url.Values{"force": {"true"}, "v": {"true"}}, nil, nil)
+}
+
+// inspectContainer returns the low level information of a container
+func (c *dockerClient) inspectContainer(id string) (Container, error) {
+	var container Container
+	err := c.call("GET", "/containers/"+id+"/json", nil, nil, &container)
+	return container, err
+}
+
+// updateContainer changes the resources of a container
+func (c *dockerClient) updateContainer(id string, resources hostConfig) error {
+	return c.call("POST", "/containers/"+id+"/update", nil, resources, nil)
+}
+
+// exec runs a command inside a running container with env added to its
+// environment and waits for it to end, returns the exit code along with the
+// combined stdout and stderr output
+func (c *dockerClient) exec(id string, cmd []string, env []string) (int, []byte, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := c.call("POST", "/containers/"+id+"/exec", nil, map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          cmd,
+		"Env":          env,
+	}, &created)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Without detaching the engine streams the output until the command ends
+	resp, err := c.do("POST", "/exec/"+created.ID+"/start", nil, map[string]bool{"Detach": false, "Tty": false})
+	if err != nil {
+		return 0, nil, err
+	}
+	out, err := demultiplex(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, out, err
+	}
+
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	err = c.call("GET", "/exec/"+created.ID+"/json", nil, nil, &inspect)
+	return inspect.ExitCode, out, err
+}
+
+// demultiplex reads a docker attach stream merging stdout and stderr frames,
+// each frame starts with an 8 bytes header holding the stream type and the
+// big endian size of the payload
+func demultiplex(r io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return out.Bytes(), err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		_, err = io.CopyN(&out, r, size)
+		if err != nil {
+			return out.Bytes(), err
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeEngine is a local stand-in for the Docker Engine API, it keeps
+// containers in memory and answers exec requests with a canned output
+type fakeEngine struct {
+	mutex      sync.Mutex
+	image      bool
+	containers map[string]*Container
+	exitCode   int
+	execCmds   [][]string
+	updates    []hostConfig
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such container"})
+	}
+	switch {
+	case r.URL.Path == "/_ping":
+		w.Write([]byte("OK"))
+	case r.URL.Path == "/images/create":
+		e.image = true
+		json.NewEncoder(w).Encode(map[string]string{"status": "Downloaded newer image"})
+	case r.URL.Path == "/containers/create":
+		if !e.image {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No such image"})
+			return
+		}
+		name := r.URL.Query().Get("name")
+		e.containers[name] = &Container{ID: name, Name: "/" + name}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": name})
+	case parts[0] == "containers" && len(parts) >= 2:
+		c, ok := e.containers[parts[1]]
+		if !ok {
+			notFound()
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(e.containers, parts[1])
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "start":
+			c.State.Running = true
+			c.NetworkSettings.Networks = map[string]EndpointSettings{"bridge": {IPAddress: "172.17.0.2"}}
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "stop":
+			c.State.Running = false
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "json":
+			json.NewEncoder(w).Encode(c)
+		case parts[2] == "update":
+			var resources hostConfig
+			json.NewDecoder(r.Body).Decode(&resources)
+			e.updates = append(e.updates, resources)
+			json.NewEncoder(w).Encode(map[string][]string{"Warnings": {}})
+		case parts[2] == "exec":
+			var body struct{ Cmd []string }
+			json.NewDecoder(r.Body).Decode(&body)
+			e.execCmds = append(e.execCmds, body.Cmd)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"Id": "exec1"})
+		}
+	case parts[0] == "exec" && parts[2] == "start":
+		// stdout frame followed by a stderr frame
+		for i, msg := range []string{"ROLE\n", "NOTICE\n"} {
+			header := make([]byte, 8)
+			header[0] = byte(i + 1)
+			binary.BigEndian.PutUint32(header[4:], uint32(len(msg)))
+			w.Write(header)
+			w.Write([]byte(msg))
+		}
+	case parts[0] == "exec" && parts[2] == "json":
+		json.NewEncoder(w).Encode(map[string]int{"ExitCode": e.exitCode})
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestDockerProvisioner(t *testing.T) (*DockerProvisioner, *fakeEngine) {
+	engine := &fakeEngine{containers: make(map[string]*Container)}
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	p := &DockerProvisioner{
+		Host:   "localhost",
+		client: &dockerClient{client: server.Client(), base: server.URL},
+	}
+	return p, engine
+}
+
+func TestDockerClientContainerLifecycle(t *testing.T) {
+	p, engine := newTestDockerProvisioner(t)
+	c := p.client
+	if err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// image is pulled on the first create
+	err := c.createContainer(testID, containerConfig{Image: postgresImage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !engine.image {
+		t.Error("Image not pulled when missing")
+	}
+	err = c.startContainer(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := c.inspectContainer(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !container.State.Running || container.IPAddress() != "172.17.0.2" {
+		t.Error("Unexpected inspect result ", container)
+	}
+	d, err := p.Describe(ServiceInstance{ID: testID, Port: 5433})
+	if err != nil || d.Target != "172.17.0.2:5432" {
+		t.Error("Running container not described with its target ", d, err)
+	}
+
+	err = c.removeContainer(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.inspectContainer(testID)
+	if !isNotFound(err) {
+		t.Error("Expected not found error after remove, got ", err)
+	}
+}
+
+func TestDockerProvisionerRoles(t *testing.T) {
+	p, engine := newTestDockerProvisioner(t)
+	si := ServiceInstance{ID: testID, Port: 5432}
+	engine.image = true
+	engine.containers[testID] = &Container{ID: testID, State: ContainerState{Running: true}}
+
+	err := p.CreateRole(si, "u1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.execCmds) != 1 || engine.execCmds[0][0] != "psql" {
+		t.Fatal("psql not executed in the container ", engine.execCmds)
+	}
+	cmd := engine.execCmds[0]
+	if !strings.Contains(cmd[len(cmd)-1], "GRANT USAGE, CREATE ON SCHEMA public TO u1") {
+		t.Error("Role not granted the public schema ", cmd)
+	}
+
+	// psql failures are returned with the command output
+	engine.exitCode = 1
+	err = p.DropRole(si, "u1")
+	if err == nil || !strings.Contains(err.Error(), "ROLE\nNOTICE") {
+		t.Error("Expected psql error with output, got ", err)
+	}
+
+	d, err := p.Describe(si)
+	if err != nil || !d.Running || d.Port != 5432 {
+		t.Error("Unexpected describe result ", d, err)
+	}
+
+	err = p.Destroy(si)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// destroying a removed instance succeeds and it is reported as stopped
+	err = p.Destroy(si)
+	if err != nil {
+		t.Error(err)
+	}
+	d, err = p.Describe(si)
+	if err != nil || d.Running {
+		t.Error("Removed instance reported as running ", err)
+	}
+}
+
+func TestDockerProvisionerUpdate(t *testing.T) {
+	p, engine := newTestDockerProvisioner(t)
+	si := ServiceInstance{ID: testID, Port: 5432}
+	engine.containers[testID] = &Container{ID: testID, State: ContainerState{Running: true}}
+
+	err := p.Update(si, Plan{Limits: PlanLimits{MemoryMB: 128}}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// downgrading to a plan without limits lifts the previous limits
+	err = p.Update(si, Plan{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []hostConfig{
+		{Memory: 128 * 1024 * 1024, MemorySwap: 128 * 1024 * 1024},
+		{Memory: -1, MemorySwap: -1},
+	}
+	if len(engine.updates) != len(expected) || engine.updates[0] != expected[0] || engine.updates[1] != expected[1] {
+		t.Error("Unexpected container updates ", engine.updates)
+	}
+}
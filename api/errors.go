@@ -0,0 +1,175 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// APIVersionHeader is the header carrying the Service Broker API version
+// used by the platform on every request
+const APIVersionHeader = "X-Broker-API-Version"
+
+// Service Broker API versions accepted by the broker, any 2.x version from
+// MinAPIMinorVersion on is supported
+const (
+	APIMajorVersion    = 2
+	MinAPIMinorVersion = 12
+)
+
+// BrokerError is an error reported to the platform as specified in CF's
+// Service Broker api, the body holds an optional machine readable error code
+// along with a description shown to users
+type BrokerError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error,omitempty"`
+	Description string `json:"description"`
+}
+
+// Error returns the description of the error
+func (e *BrokerError) Error() string {
+	if e.Code != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Description
+}
+
+// Error codes defined by CF's Service Broker api
+var (
+	// ErrAsyncRequired is returned when the broker only processes a request
+	// asynchronously and the platform did not send accepts_incomplete=true
+	ErrAsyncRequired = &BrokerError{
+		Status:      http.StatusUnprocessableEntity,
+		Code:        "AsyncRequired",
+		Description: "This service plan requires client support for asynchronous service operations.",
+	}
+	// ErrConcurrency is returned while another operation is in progress
+	// for the same service instance
+	ErrConcurrency = &BrokerError{
+		Status:      http.StatusUnprocessableEntity,
+		Code:        "ConcurrencyError",
+		Description: "Another operation for this service instance is in progress.",
+	}
+	// ErrRequiresApp is returned when a binding is requested without an
+	// application for a service which only supports application bindings
+	ErrRequiresApp = &BrokerError{
+		Status:      http.StatusUnprocessableEntity,
+		Code:        "RequiresApp",
+		Description: "This service supports generation of credentials through binding an application only.",
+	}
+)
+
+// Errors reported on malformed requests
+var (
+	errInvalidInstanceID = NewBadRequestError("The service instance ID must be a valid UUID")
+	errInvalidBindingID  = NewBadRequestError("The service instance and binding IDs must be valid UUIDs")
+	errInvalidQuery      = NewBadRequestError("service_id and plan_id query parameters must be valid UUIDs")
+	errUnknownInstance   = NewBadRequestError("The service instance does not exist")
+	errNoPortAvailable   = &BrokerError{
+		Status:      http.StatusServiceUnavailable,
+		Description: "The broker has reached its maximum number of service instances, no port is available",
+	}
+	errInstanceConflict = &BrokerError{
+		Status:      http.StatusConflict,
+		Description: "A service instance with the same ID already exists with different attributes",
+	}
+	errBindingConflict = &BrokerError{
+		Status:      http.StatusConflict,
+		Description: "A service binding with the same ID already exists with different attributes",
+	}
+	errNoSuchInstance = &BrokerError{
+		Status:      http.StatusNotFound,
+		Description: "The service instance does not exist or is still being provisioned",
+	}
+	errNoSuchBinding = &BrokerError{
+		Status:      http.StatusNotFound,
+		Description: "The service binding does not exist",
+	}
+)
+
+// NewBadRequestError returns a 400 Bad Request error with the description
+func NewBadRequestError(description string) *BrokerError {
+	return &BrokerError{Status: http.StatusBadRequest, Description: description}
+}
+
+// NewInternalError returns a 500 Internal Server Error reporting err
+func NewInternalError(err error) *BrokerError {
+	return &BrokerError{
+		Status:      http.StatusInternalServerError,
+		Description: "The broker failed to process the request: " + err.Error(),
+	}
+}
+
+// writeError sets the status and the body of a response to the error
+func writeError(status *int, body *[]byte, e *BrokerError) {
+	*status = e.Status
+	*body, _ = json.Marshal(e)
+}
+
+// respondError writes the error on w, used by middlewares which do not follow
+// the deferred write of handlers
+func respondError(w http.ResponseWriter, e *BrokerError) {
+	var status int
+	var body []byte
+	writeError(&status, &body, e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	if err != nil {
+		slog.Warn("writing the response failed", "error", err)
+	}
+}
+
+// IsSupportedAPIVersion verifies that version is a "major.minor" version
+// supported by the broker
+func IsSupportedAPIVersion(version string) bool {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major == APIMajorVersion && minor >= MinAPIMinorVersion
+}
+
+// APIVersionMiddleware rejects requests with a missing or unsupported
+// X-Broker-API-Version header with 412 Precondition Failed
+func APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get(APIVersionHeader)
+		if IsSupportedAPIVersion(version) == false {
+			respondError(w, &BrokerError{
+				Status: http.StatusPreconditionFailed,
+				Description: "Unsupported " + APIVersionHeader + " " + strconv.Quote(version) +
+					", the broker supports " + strconv.Itoa(APIMajorVersion) + "." +
+					strconv.Itoa(MinAPIMinorVersion) + " or later 2.x versions",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,182 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIVersionMiddleware(t *testing.T) {
+	handler := APIVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		version string
+		status  int
+	}{
+		{"2.12", http.StatusOK},
+		{"2.17", http.StatusOK},
+		{"2.11", http.StatusPreconditionFailed},
+		{"3.0", http.StatusPreconditionFailed},
+		{"two", http.StatusPreconditionFailed},
+		{"", http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/v2/catalog", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.version != "" {
+			req.Header.Set(APIVersionHeader, test.version)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Error("Version ", test.version, ": expected status ", test.status, " got ", rr.Code)
+		}
+		if rr.Code == http.StatusPreconditionFailed {
+			var e BrokerError
+			err = json.NewDecoder(rr.Body).Decode(&e)
+			if err != nil || e.Description == "" {
+				t.Error("Version ", test.version, ": 412 response without description")
+			}
+		}
+	}
+}
+
+// TestBrokerErrorBodies validates that failed requests describe the problem
+// and carry the error codes defined by the API
+func TestBrokerErrorBodies(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner(),
+		RequireAsync: true}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Deprovision).Methods("DELETE")
+
+	provisionBody := `{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`
+	queryValues := url.Values{}
+	queryValues.Add("service_id", "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60")
+	queryValues.Add("plan_id", "83c8811b-f3db-17ef-6eb3-bbe944b47262")
+
+	tests := []struct {
+		method string
+		uri    string
+		body   string
+		status int
+		code   string
+	}{
+		{"PUT", "/v2/service_instances/" + invalidID, provisionBody, http.StatusBadRequest, ""},
+		{"PUT", "/v2/service_instances/" + testID, `{"service_id":"123"}`, http.StatusBadRequest, ""},
+		{"PUT", "/v2/service_instances/" + testID, provisionBody, http.StatusUnprocessableEntity, "AsyncRequired"},
+		{"DELETE", "/v2/service_instances/" + testID + "?" + queryValues.Encode(), "",
+			http.StatusUnprocessableEntity, "AsyncRequired"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.uri, bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Error(test.method, " ", test.uri, ": expected status ", test.status, " got ", rr.Code)
+		}
+		var e BrokerError
+		err = json.NewDecoder(rr.Body).Decode(&e)
+		switch {
+		case err != nil:
+			t.Error(test.method, " ", test.uri, ": invalid error body ", err)
+		case e.Description == "":
+			t.Error(test.method, " ", test.uri, ": error body without description")
+		case e.Code != test.code:
+			t.Error(test.method, " ", test.uri, ": expected error ", test.code, " got ", e.Code)
+		}
+	}
+}
+
+// TestBrokerConcurrencyError validates that operations on an instance are
+// rejected while an asynchronous operation is in progress
+func TestBrokerConcurrencyError(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeyring(testKeyring(t))
+
+	for _, store := range []Store{NewMemoryStore(), s} {
+		dbhandler := DbHandler{Store: store, Provisioner: NewMemoryProvisioner()}
+		if _, err = dbhandler.Add(testID, ProvisionRequest{}, dbhandler.logger()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Concurrent requests cannot both start an operation
+		const requests = 10
+		started := make(chan Operation, requests)
+		var wg sync.WaitGroup
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				op, err := dbhandler.StartOperation(testID, OperationUpdate)
+				switch {
+				case err == nil:
+					started <- op
+				case err != ErrOperationInProgress:
+					t.Error("Expected ErrOperationInProgress got ", err)
+				}
+			}()
+		}
+		wg.Wait()
+		close(started)
+		if len(started) != 1 {
+			t.Fatal("Expected one operation to start got ", len(started))
+		}
+		op := <-started
+
+		if _, err = dbhandler.AddBinding(testID, inexistentID, BindRequest{}, dbhandler.logger()); err != ErrOperationInProgress {
+			t.Error("Expected ErrOperationInProgress on bind got ", err)
+		}
+		dbhandler.finishOperation(op, dbhandler.logger(), errors.New("update failed"))
+		if _, err = dbhandler.StartOperation(testID, OperationDeprovision); err != nil {
+			t.Error("Expected the operation to start once the previous one finished got ", err)
+		}
+		if _, err = dbhandler.StartOperation(inexistentID, OperationDeprovision); err != ErrInstanceNotFound {
+			t.Error("Expected ErrInstanceNotFound got ", err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Port forwarding modes
+const (
+	// ForwardingDocker publishes the instance's port on the container, the
+	// Docker Engine manages the forwarding
+	ForwardingDocker = "docker"
+	// ForwardingIPTables forwards ports with DNAT rules managed by the broker
+	ForwardingIPTables = "iptables"
+	// ForwardingNone does not forward ports, meant for tests and
+	// unprivileged environments
+	ForwardingNone = "none"
+)
+
+// ForwardChain is the iptables nat chain holding the rules managed by
+// IPTablesForwarder
+const ForwardChain = "CF_POSTGRESQL_BROKER"
+
+// ForwardRule forwards the port allocated to an instance to the address the
+// instance listens on
+type ForwardRule struct {
+	InstanceID string
+	Port       int
+	// Target is the "ip:port" address of the instance
+	Target string
+}
+
+// PortForwarder exposes the ports of service instances running on internal
+// addresses
+type PortForwarder interface {
+	// Add forwards the rule's port, adding a rule already in place succeeds
+	Add(rule ForwardRule) error
+	// Remove stops forwarding the rule's port, missing rules are ignored
+	Remove(rule ForwardRule) error
+	// Sync replaces every rule in place with rules
+	Sync(rules []ForwardRule) error
+}
+
+// NewPortForwarder returns the forwarder of a forwarding mode, nil for modes
+// where the provisioner exposes the ports itself
+func NewPortForwarder(mode string) (PortForwarder, error) {
+	switch mode {
+	case ForwardingDocker:
+		return nil, nil
+	case ForwardingIPTables:
+		return NewIPTablesForwarder(), nil
+	case ForwardingNone:
+		return NewMemoryForwarder(), nil
+	default:
+		return nil, fmt.Errorf("unknown port forwarding %q", mode)
+	}
+}
+
+// IPTablesForwarder keeps a DNAT rule per instance on a dedicated chain of
+// the nat table, jumped to from PREROUTING and OUTPUT. The chain only holds
+// rules of the broker so it can be rebuilt from the state store
+type IPTablesForwarder struct {
+	mutex sync.Mutex
+	// run executes iptables, replaced on tests
+	run func(args ...string) error
+}
+
+// NewIPTablesForwarder returns a forwarder running the iptables command
+func NewIPTablesForwarder() *IPTablesForwarder {
+	return &IPTablesForwarder{run: runIPTables}
+}
+
+func runIPTables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ruleArgs returns the arguments identifying the rule on the chain
+func ruleArgs(rule ForwardRule) []string {
+	return []string{"-p", "tcp", "--dport", strconv.Itoa(rule.Port), "-j", "DNAT",
+		"--to-destination", rule.Target, "-m", "comment", "--comment", rule.InstanceID}
+}
+
+// setup creates the chain and the jumps to it when missing
+func (f *IPTablesForwarder) setup() error {
+	if f.run("-t", "nat", "-L", ForwardChain, "-n") != nil {
+		err := f.run("-t", "nat", "-N", ForwardChain)
+		if err != nil {
+			return err
+		}
+	}
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		jump := []string{chain, "-m", "addrtype", "--dst-type", "LOCAL", "-j", ForwardChain}
+		if f.run(append([]string{"-t", "nat", "-C"}, jump...)...) != nil {
+			err := f.run(append([]string{"-t", "nat", "-A"}, jump...)...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Add appends the rule to the chain unless it is already there
+func (f *IPTablesForwarder) Add(rule ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.setup()
+	if err != nil {
+		return err
+	}
+	if f.run(append([]string{"-t", "nat", "-C", ForwardChain}, ruleArgs(rule)...)...) == nil {
+		return nil
+	}
+	return f.run(append([]string{"-t", "nat", "-A", ForwardChain}, ruleArgs(rule)...)...)
+}
+
+// Remove deletes the rule from the chain
+func (f *IPTablesForwarder) Remove(rule ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.run(append([]string{"-t", "nat", "-C", ForwardChain}, ruleArgs(rule)...)...) != nil {
+		return nil
+	}
+	return f.run(append([]string{"-t", "nat", "-D", ForwardChain}, ruleArgs(rule)...)...)
+}
+
+// Sync flushes the chain and appends rules, stale rules pointing at removed
+// instances or old container addresses are dropped
+func (f *IPTablesForwarder) Sync(rules []ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.setup()
+	if err != nil {
+		return err
+	}
+	err = f.run("-t", "nat", "-F", ForwardChain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = f.run(append([]string{"-t", "nat", "-A", ForwardChain}, ruleArgs(rule)...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryForwarder only records the rules in place, nothing is forwarded
+type MemoryForwarder struct {
+	mutex sync.Mutex
+	rules map[string]ForwardRule
+}
+
+// NewMemoryForwarder returns a MemoryForwarder without rules
+func NewMemoryForwarder() *MemoryForwarder {
+	return &MemoryForwarder{rules: make(map[string]ForwardRule)}
+}
+
+// Add records the rule
+func (f *MemoryForwarder) Add(rule ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules[rule.InstanceID] = rule
+	return nil
+}
+
+// Remove forgets the rule
+func (f *MemoryForwarder) Remove(rule ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.rules, rule.InstanceID)
+	return nil
+}
+
+// Sync replaces the recorded rules
+func (f *MemoryForwarder) Sync(rules []ForwardRule) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules = make(map[string]ForwardRule)
+	for _, rule := range rules {
+		f.rules[rule.InstanceID] = rule
+	}
+	return nil
+}
+
+// Rules returns the recorded rules
+func (f *MemoryForwarder) Rules() []ForwardRule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var rules []ForwardRule
+	for _, rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -0,0 +1,141 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIPTablesForwarder(t *testing.T) {
+	// fake iptables holding the rules of the chain, checks fail for
+	// missing rules
+	chain := make(map[string]bool)
+	var commands []string
+	f := &IPTablesForwarder{run: func(args ...string) error {
+		command := strings.Join(args, " ")
+		commands = append(commands, command)
+		rule := strings.Join(args[3:], " ")
+		switch args[2] {
+		case "-C":
+			if !chain[rule] {
+				return errors.New("rule does not exist")
+			}
+		case "-A":
+			chain[rule] = true
+		case "-D":
+			delete(chain, rule)
+		case "-F":
+			for rule := range chain {
+				if strings.HasPrefix(rule, ForwardChain) {
+					delete(chain, rule)
+				}
+			}
+		}
+		return nil
+	}}
+
+	rule := ForwardRule{InstanceID: testID, Port: 5432, Target: "172.17.0.2:5432"}
+	if err := f.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	var appended int
+	for _, command := range commands {
+		if strings.HasPrefix(command, "-t nat -A "+ForwardChain) {
+			appended++
+		}
+	}
+	if appended != 1 {
+		t.Error("Expected one rule appended to the chain, got ", commands)
+	}
+
+	if err := f.Remove(rule); err != nil {
+		t.Fatal(err)
+	}
+	for r := range chain {
+		if strings.HasPrefix(r, ForwardChain) {
+			t.Error("Rule left on the chain after remove ", r)
+		}
+	}
+
+	moved := rule
+	moved.Target = "172.17.0.3:5432"
+	if err := f.Add(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync([]ForwardRule{moved}); err != nil {
+		t.Fatal(err)
+	}
+	if chain[ForwardChain+" "+strings.Join(ruleArgs(rule), " ")] ||
+		!chain[ForwardChain+" "+strings.Join(ruleArgs(moved), " ")] {
+		t.Error("Chain not replaced by sync ", chain)
+	}
+}
+
+func TestDbHandlerForwarding(t *testing.T) {
+	const planID = "83c8811b-f3db-17ef-6eb3-bbe944b47262"
+	provisioner := NewMemoryProvisioner()
+	forwarder := NewMemoryForwarder()
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: provisioner, Forwarder: forwarder}
+
+	si, err := dbhandler.Add(testID, ProvisionRequest{PlanID: planID}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarder.Rules()) != 0 {
+		t.Error("Instance without target forwarded ", forwarder.Rules())
+	}
+
+	// updates forward the new address of the instance
+	provisioner.SetTarget(testID, "172.17.0.2:5432")
+	plan, _ := dbhandler.findPlan(planID)
+	err = dbhandler.ChangePlan(testID, plan, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := forwarder.Rules()
+	if len(rules) != 1 || rules[0].Port != si.Port || rules[0].Target != "172.17.0.2:5432" {
+		t.Error("Unexpected rules after update ", rules)
+	}
+
+	// stale rules are replaced at startup
+	provisioner.SetTarget(testID, "172.17.0.3:5432")
+	forwarder.Sync([]ForwardRule{{InstanceID: inexistentID, Port: 6000, Target: "172.17.0.9:5432"}})
+	err = dbhandler.SyncForwarding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = forwarder.Rules()
+	if len(rules) != 1 || rules[0].InstanceID != testID || rules[0].Target != "172.17.0.3:5432" {
+		t.Error("Unexpected rules after sync ", rules)
+	}
+
+	removed, err := dbhandler.Remove(testID)
+	if err != nil || !removed {
+		t.Fatal("Instance not removed ", err)
+	}
+	if len(forwarder.Rules()) != 0 {
+		t.Error("Rule left after deprovision ", forwarder.Rules())
+	}
+	if _, err = dbhandler.Store.GetForwardRule(testID); err != ErrForwardRuleNotFound {
+		t.Error("Expected ErrForwardRuleNotFound after deprovision, got ", err)
+	}
+}
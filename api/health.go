@@ -0,0 +1,142 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds each readiness check, backends which do not answer in
+// time are reported as failing
+const readyTimeout = 5 * time.Second
+
+// Health check statuses
+const (
+	healthOK      = "ok"
+	healthFailing = "failing"
+)
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthResponse is returned by the health endpoints, Status is failing when
+// any of the checks fails
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// Healthz reports the broker process is alive, it does not depend on the
+// state store or the backend so a failing dependency does not get the
+// process restarted
+func (h *DbHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{Status: healthOK})
+}
+
+// Readyz reports whether the broker can serve requests: the state store is
+// reachable, the provisioner backend responds and the TLS certificate is
+// valid. Responds 503 Service Unavailable when any check fails
+func (h *DbHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func() (string, error){
+		"state_store": func() (string, error) { return "", h.Store.Ping() },
+		"provisioner": func() (string, error) { return "", h.Provisioner.Ping() },
+	}
+	if h.Certificate != nil {
+		checks["tls_certificate"] = h.checkCertificate
+	}
+
+	response := HealthResponse{Status: healthOK, Checks: make(map[string]HealthCheck)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() (string, error)) {
+			defer wg.Done()
+			result := runHealthCheck(check)
+			mutex.Lock()
+			defer mutex.Unlock()
+			response.Checks[name] = result
+			if result.Status != healthOK {
+				response.Status = healthFailing
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	writeHealth(w, response)
+}
+
+// runHealthCheck runs check, giving up after readyTimeout
+func runHealthCheck(check func() (string, error)) HealthCheck {
+	type outcome struct {
+		detail string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := check()
+		done <- outcome{detail, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return HealthCheck{Status: healthFailing, Error: o.err.Error(), Detail: o.detail}
+		}
+		return HealthCheck{Status: healthOK, Detail: o.detail}
+	case <-time.After(readyTimeout):
+		return HealthCheck{Status: healthFailing, Error: fmt.Sprintf("no answer within %v", readyTimeout)}
+	}
+}
+
+// checkCertificate fails when the certificate is expired or not valid yet,
+// the detail holds its expiry date
+func (h *DbHandler) checkCertificate() (string, error) {
+	now := time.Now()
+	detail := "expires " + h.Certificate.NotAfter.UTC().Format(time.RFC3339)
+	switch {
+	case now.After(h.Certificate.NotAfter):
+		return detail, fmt.Errorf("certificate expired")
+	case now.Before(h.Certificate.NotBefore):
+		return detail, fmt.Errorf("certificate not valid before %s",
+			h.Certificate.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return detail, nil
+}
+
+// writeHealth writes a health response, 503 when it is failing
+func writeHealth(w http.ResponseWriter, response HealthResponse) {
+	status := http.StatusOK
+	if response.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	if err != nil {
+		slog.Warn("writing the response failed", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readyz(t *testing.T, dbhandler *DbHandler) (int, HealthResponse) {
+	rr := httptest.NewRecorder()
+	dbhandler.Readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+	var response HealthResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, response
+}
+
+func TestHealthz(t *testing.T) {
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewDockerProvisioner("/nonexistent.sock", "")}
+	rr := httptest.NewRecorder()
+	dbhandler.Healthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Error("Liveness depends on the backend, got ", rr.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	now := time.Now()
+	dbhandler := DbHandler{
+		Store:       NewMemoryStore(),
+		Provisioner: NewMemoryProvisioner(),
+		Certificate: &x509.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+	}
+	status, response := readyz(t, &dbhandler)
+	if status != http.StatusOK || response.Status != healthOK || len(response.Checks) != 3 {
+		t.Error("Expected the broker to be ready ", status, response)
+	}
+	if response.Checks["tls_certificate"].Detail == "" {
+		t.Error("Certificate expiry not reported ", response.Checks)
+	}
+
+	dbhandler.Certificate.NotAfter = now.Add(-time.Minute)
+	dbhandler.Provisioner = NewDockerProvisioner("/nonexistent.sock", "")
+	status, response = readyz(t, &dbhandler)
+	if status != http.StatusServiceUnavailable || response.Status != healthFailing {
+		t.Error("Expected the broker not to be ready ", status, response)
+	}
+	for _, name := range []string{"provisioner", "tls_certificate"} {
+		if check := response.Checks[name]; check.Status != healthFailing || check.Error == "" {
+			t.Errorf("Check %s not failing: %+v", name, check)
+		}
+	}
+	if response.Checks["state_store"].Status != healthOK {
+		t.Error("State store check failing ", response.Checks["state_store"])
+	}
+}
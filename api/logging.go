@@ -0,0 +1,104 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/cloudfoundry-community/cf-postgresql-broker/util"
+)
+
+// Request correlation headers
+const (
+	// RequestIDHeader carries the ID of a request, generated when the client
+	// does not send one and returned on every response
+	RequestIDHeader = "X-Request-ID"
+	// RequestIdentityHeader is the request ID sent by platforms speaking
+	// version 2.15 or later of the Service Broker API, it takes precedence
+	// over RequestIDHeader
+	RequestIdentityHeader = "X-Broker-API-Request-Identity"
+)
+
+// requestIDBytes is the size of generated request IDs
+const requestIDBytes = 16
+
+// maxRequestIDLength bounds the request IDs accepted from clients, longer IDs
+// are replaced by a generated one
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// NewLogger returns a logger writing JSON lines to w, records below level
+// ("debug", "info", "warn" or "error") are dropped
+func NewLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+}
+
+// RequestIDMiddleware tags each request with the ID sent by the client, or a
+// generated one, which is returned on the X-Request-ID response header and
+// added to the request's log lines
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdentityHeader)
+		if id == "" {
+			id = r.Header.Get(RequestIDHeader)
+		}
+		if id == "" || len(id) > maxRequestIDLength {
+			var err error
+			id, err = util.GenerateRandomString(requestIDBytes)
+			if err != nil {
+				slog.Error("generating a request ID failed", "error", err)
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID of the request set by RequestIDMiddleware, empty
+// when the middleware is not in use
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the logger of the handler
+func (h *DbHandler) logger() *slog.Logger {
+	if h.Logger == nil {
+		return slog.Default()
+	}
+	return h.Logger
+}
+
+// requestLogger returns the logger of the handler tagged with the ID of the
+// request
+func (h *DbHandler) requestLogger(r *http.Request) *slog.Logger {
+	id := RequestID(r.Context())
+	if id == "" {
+		return h.logger()
+	}
+	return h.logger().With("request_id", id)
+}
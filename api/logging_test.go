@@ -0,0 +1,88 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/catalog", nil))
+	if seen == "" || rr.Header().Get(RequestIDHeader) != seen {
+		t.Error("Request ID not generated ", seen, rr.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	req.Header.Set(RequestIDHeader, "from-proxy")
+	req.Header.Set(RequestIdentityHeader, "from-platform")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if seen != "from-platform" || rr.Header().Get(RequestIDHeader) != "from-platform" {
+		t.Error("Platform request identity not propagated ", seen, rr.Header())
+	}
+}
+
+func TestProvisionLogs(t *testing.T) {
+	const planID = "83c8811b-f3db-17ef-6eb3-bbe944b47262"
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner(), Logger: logger}
+
+	r := mux.NewRouter()
+	r.Use(RequestIDMiddleware)
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+testID, bytes.NewBufferString(`{
+		"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		"plan_id":"`+planID+`",
+		"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+		"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+	}`))
+	req.Header.Set(RequestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var line map[string]interface{}
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatal("Log line is not JSON: ", scanner.Text())
+		}
+		if line["request_id"] != "req-1" || line["instance_id"] != testID || line["plan_id"] != planID {
+			t.Error("Log line not tagged with the request ", line)
+		}
+	}
+	if lines == 0 {
+		t.Error("Provision not logged")
+	}
+}
@@ -0,0 +1,197 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the name of every broker metric
+const metricsNamespace = "postgresql_broker"
+
+// Operation outcomes counted by the metrics
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+)
+
+// operationBind labels binding creations, which are not tracked as
+// asynchronous operations
+const operationBind = "bind"
+
+// Metrics exposes Prometheus metrics about the requests served by the
+// broker, the operations executed on the provisioner and the state of the
+// instances. A nil *Metrics records nothing
+type Metrics struct {
+	registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+}
+
+// NewMetrics returns the metrics of the broker, instance counts, port
+// allocation and background jobs are read from h on each scrape
+func NewMetrics(h *DbHandler) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests served by route, method and status code",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve requests by route, method and status code",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Provision, update, deprovision and bind operations by plan and outcome",
+		}, []string{"operation", "plan", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by the provisioner to execute operations by plan",
+			// Provisions pulling an image may take minutes
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"operation", "plan"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.operations,
+		m.operationDuration,
+		&stateCollector{h: h},
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware counts and times the requests of the routes of a mux router,
+// labelled by route template so instance IDs do not make up new series
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+		code := strconv.Itoa(recorder.status)
+		m.requestDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(started).Seconds())
+		m.requests.WithLabelValues(route, r.Method, code).Inc()
+	})
+}
+
+// observeOperation records the outcome and duration of an operation started
+// at started
+func (m *Metrics) observeOperation(operation string, plan string, started time.Time, err error) {
+	if m == nil {
+		return
+	}
+	outcome := outcomeSucceeded
+	if err != nil {
+		outcome = outcomeFailed
+	}
+	m.operations.WithLabelValues(operation, plan, outcome).Inc()
+	m.operationDuration.WithLabelValues(operation, plan).Observe(time.Since(started).Seconds())
+}
+
+var (
+	instancesDesc = prometheus.NewDesc(metricsNamespace+"_instances",
+		"Service instances registered by plan", []string{"plan"}, nil)
+	portsAllocatedDesc = prometheus.NewDesc(metricsNamespace+"_ports_allocated",
+		"Ports of the port range allocated to instances", nil, nil)
+	portsDesc = prometheus.NewDesc(metricsNamespace+"_ports",
+		"Size of the port range allocated to instances", nil, nil)
+	jobsDesc = prometheus.NewDesc(metricsNamespace+"_background_jobs",
+		"Asynchronous operations running in background", nil, nil)
+)
+
+// stateCollector reads the gauges describing the broker state on scrape
+type stateCollector struct {
+	h *DbHandler
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+	ch <- portsAllocatedDesc
+	ch <- portsDesc
+	ch <- jobsDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.h.jobMutex.Lock()
+	jobs := len(c.h.running)
+	c.h.jobMutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(jobs))
+
+	ports := c.h.portRange()
+	ch <- prometheus.MustNewConstMetric(portsDesc, prometheus.GaugeValue, float64(ports.Max-ports.Min+1))
+
+	// The store is checked by the readiness endpoint, the gauges the store
+	// fails to answer are left out of the scrape
+	allocated, err := c.h.Store.CountPorts(ports)
+	if err != nil {
+		c.h.logger().Error("counting the allocated ports for metrics failed", "error", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(portsAllocatedDesc, prometheus.GaugeValue, float64(allocated))
+	}
+
+	instances, err := c.h.Store.ListInstances()
+	if err != nil {
+		c.h.logger().Error("listing the instances for metrics failed", "error", err)
+		return
+	}
+	plans := make(map[string]int)
+	for _, si := range instances {
+		plans[si.PlanID]++
+	}
+	for plan, count := range plans {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(count), plan)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMetrics(t *testing.T) {
+	const planID = "83c8811b-f3db-17ef-6eb3-bbe944b47262"
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: NewMemoryProvisioner(),
+		Ports: PortRange{Min: 6000, Max: 6009}}
+	dbhandler.Metrics = NewMetrics(&dbhandler)
+
+	r := mux.NewRouter()
+	r.Use(dbhandler.Metrics.Middleware)
+	r.HandleFunc("/v2/service_instances/{id}", dbhandler.Provision).Methods("PUT")
+	for _, id := range []string{testID, invalidID} {
+		req, err := http.NewRequest("PUT", "/v2/service_instances/"+id, bytes.NewBufferString(`{
+			"service_id":"5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+			"plan_id":"`+planID+`",
+			"organization_guid":"41653aa4-3a3a-486a-4431-ef258b39f042",
+			"space_guid":"41653aa4-3a3a-486a-4431-ef258b39f042"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Ports are counted in the range whether or not an instance holds them
+	for _, r := range []PortRange{{Min: 6000, Max: 6009}, {Min: 7000, Max: 7000}} {
+		if _, err := dbhandler.Store.AllocatePort(inexistentID, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	dbhandler.Metrics.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rr.Body)
+	for _, series := range []string{
+		`postgresql_broker_http_requests_total{code="201",method="PUT",route="/v2/service_instances/{id}"} 1`,
+		`postgresql_broker_http_requests_total{code="400",method="PUT",route="/v2/service_instances/{id}"} 1`,
+		`postgresql_broker_operations_total{operation="provision",outcome="succeeded",plan="` + planID + `"} 1`,
+		`postgresql_broker_operation_duration_seconds_count{operation="provision",plan="` + planID + `"} 1`,
+		`postgresql_broker_instances{plan="` + planID + `"} 1`,
+		`postgresql_broker_http_request_duration_seconds_count{code="201",method="PUT",route="/v2/service_instances/{id}"} 1`,
+		`postgresql_broker_ports_allocated 2`,
+		`postgresql_broker_ports 10`,
+		`postgresql_broker_background_jobs 0`,
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("Series %s not exposed", series)
+		}
+	}
+}
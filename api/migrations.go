@@ -0,0 +1,231 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// versionTable records the migrations applied to the state database
+const versionTable = "schema_version"
+
+// Migration is a numbered change of the state database schema, migrations
+// are applied in order and never modified once released
+type Migration struct {
+	Version     int
+	Description string
+	// SQLiteStatements are applied before Statements on sqlite databases
+	// only, they clean up the rows written by releases without migrations
+	SQLiteStatements []string
+	Statements       []string
+}
+
+// migrations holds every schema change of the state database. The first one
+// is the schema created by releases without migrations, so their databases
+// are upgraded in place. New migrations are appended with the next version
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create service_instance table",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS " + table + "(id TEXT, service TEXT, port INTEGER, info TEXT);",
+		},
+	},
+	{
+		Version:     2,
+		Description: "create service_binding table",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS " + bindingTable +
+				"(id TEXT, instance_id TEXT, username TEXT, password TEXT);",
+		},
+	},
+	{
+		Version:     3,
+		Description: "create operation table",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS " + operationTable +
+				"(id TEXT, instance_id TEXT, type TEXT, state TEXT, description TEXT, created BIGINT);",
+		},
+	},
+	{
+		Version:     4,
+		Description: "add plan and storage quota state to service instances",
+		Statements: []string{
+			"ALTER TABLE " + table + " ADD COLUMN plan_id TEXT;",
+			"ALTER TABLE " + table + " ADD COLUMN quota_exceeded INTEGER DEFAULT 0;",
+		},
+	},
+	{
+		Version:     5,
+		Description: "add provision attributes and unique IDs to service instances",
+		// Instances provisioned concurrently may have been registered
+		// twice, the first row is kept and the port of the others is
+		// released along with them
+		SQLiteStatements: []string{
+			"DELETE FROM " + table + " WHERE rowid NOT IN (SELECT MIN(rowid) FROM " + table + " GROUP BY id);",
+		},
+		Statements: []string{
+			"ALTER TABLE " + table + " ADD COLUMN service_id TEXT;",
+			"ALTER TABLE " + table + " ADD COLUMN organization_guid TEXT;",
+			"ALTER TABLE " + table + " ADD COLUMN space_guid TEXT;",
+			"CREATE UNIQUE INDEX " + table + "_id ON " + table + "(id);",
+		},
+	},
+	{
+		Version:     6,
+		Description: "create port table holding the ports allocated to service instances",
+		Statements: []string{
+			"CREATE TABLE " + portTable + "(port INTEGER PRIMARY KEY, instance_id TEXT);",
+			// Instances provisioned concurrently may share a port, it
+			// stays allocated to one of them
+			"INSERT INTO " + portTable + "(port, instance_id) SELECT port, MIN(id) FROM " + table +
+				" WHERE port IS NOT NULL GROUP BY port;",
+		},
+	},
+	{
+		Version:     7,
+		Description: "create forward_rule table tracking the forwarded ports of service instances",
+		Statements: []string{
+			"CREATE TABLE " + forwardTable + "(instance_id TEXT PRIMARY KEY, port INTEGER, target TEXT);",
+		},
+	},
+	{
+		Version:     8,
+		Description: "add encrypted admin passwords to service instances",
+		Statements: []string{
+			"ALTER TABLE " + table + " ADD COLUMN admin_password TEXT;",
+		},
+	},
+	{
+		Version:     9,
+		Description: "record the state keys encrypting instance and binding secrets",
+		Statements: []string{
+			"ALTER TABLE " + table + " ADD COLUMN key_id TEXT;",
+			"ALTER TABLE " + bindingTable + " ADD COLUMN key_id TEXT;",
+		},
+	},
+	{
+		Version:     10,
+		Description: "add request parameters to service instances and bindings",
+		Statements: []string{
+			"ALTER TABLE " + table + " ADD COLUMN parameters TEXT;",
+			"ALTER TABLE " + bindingTable + " ADD COLUMN parameters TEXT;",
+		},
+	},
+}
+
+// String describes the migration
+func (m Migration) String() string {
+	return fmt.Sprintf("%d: %s", m.Version, m.Description)
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, 0 if none. The database is only read, so that dry runs leave it
+// untouched
+func (s *SQLStore) SchemaVersion() (int, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;"
+	if s.driver == StorePostgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables " +
+			"WHERE table_schema = current_schema() AND table_name = ?;"
+	}
+	var tables int
+	err := s.db.QueryRow(s.rebind(query), versionTable).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + versionTable + ";").Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database
+func (s *SQLStore) PendingMigrations() ([]Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each one in its own
+// transaction along with its schema_version record
+func (s *SQLStore) Migrate() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + versionTable +
+		"(version INTEGER PRIMARY KEY, description TEXT, applied BIGINT);")
+	if err != nil {
+		return err
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		err = s.migrate(m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %v", m, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) migrate(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	// Brokers sharing a PostgreSQL database may start at once, the first
+	// one applies the migration and the others skip it
+	if s.driver == StorePostgres {
+		_, err = tx.Exec("LOCK TABLE " + versionTable + " IN EXCLUSIVE MODE;")
+		if err != nil {
+			return err
+		}
+		var applied int
+		err = tx.QueryRow(s.rebind("SELECT COUNT(*) FROM "+versionTable+" WHERE version = ?;"),
+			m.Version).Scan(&applied)
+		if err != nil || applied > 0 {
+			return err
+		}
+	}
+
+	var statements []string
+	if s.driver == StoreSQLite {
+		statements = append(statements, m.SQLiteStatements...)
+	}
+	statements = append(statements, m.Statements...)
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(s.rebind("INSERT INTO "+versionTable+"(version, description, applied) VALUES(?, ?, ?);"),
+		m.Version, m.Description, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
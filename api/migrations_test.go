@@ -0,0 +1,110 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Error("Migration ", m, " expected to have version ", i+1)
+		}
+	}
+}
+
+// TestMigrateLegacyDatabase upgrades a database created by releases without
+// migrations, its instances must survive the upgrade
+func TestMigrateLegacyDatabase(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.Exec("CREATE TABLE IF NOT EXISTS service_instance(id TEXT, service TEXT, port INTEGER, info TEXT);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec("INSERT INTO service_instance(id, service, port, info) VALUES(?, 'psql', 5432, 'example');",
+		testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent provisions of legacy releases registered instances twice
+	_, err = s.db.Exec("INSERT INTO service_instance(id, service, port, info) VALUES(?, 'psql', 5433, 'example');",
+		testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := s.PendingMigrations()
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatal("Expected every migration to be pending got ", pending, err)
+	}
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil || version != len(migrations) {
+		t.Error("Expected schema version ", len(migrations), " got ", version, err)
+	}
+	si, err := s.GetInstance(testID)
+	if err != nil || si.Port != 5432 || si.QuotaExceeded {
+		t.Error("Legacy instance not migrated ", si, err)
+	}
+
+	port, err := s.AllocatePort(inexistentID, PortRange{Min: 5432, Max: 5433})
+	if err != nil || port != 5433 {
+		t.Error("Port of the legacy instance not allocated or port of its duplicate not released, got ", port, err)
+	}
+
+	// Migrating an up to date database does nothing
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = s.PendingMigrations()
+	if err != nil || len(pending) != 0 {
+		t.Error("Expected no pending migration got ", pending, err)
+	}
+	if err = s.CreateInstance(si); err != ErrInstanceExists {
+		t.Error("Duplicated instance: expected ErrInstanceExists got ", err)
+	}
+}
+
+// TestPendingMigrationsReadOnly validates that listing the pending migrations
+// of a new database, as the dry run does, leaves it untouched
+func TestPendingMigrationsReadOnly(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "new.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pending, err := s.PendingMigrations()
+	if err != nil || len(pending) != len(migrations) {
+		t.Fatal("Expected every migration to be pending got ", pending, err)
+	}
+	var tables int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table';").Scan(&tables)
+	if err != nil || tables != 0 {
+		t.Error("Expected no table to be created got ", tables, err)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Provisioner abstracts the backend running the PostgreSQL service instances,
+// DbHandler keeps the bookkeeping of instances and delegates the lifecycle of
+// the actual databases to it
+type Provisioner interface {
+	// Create starts a new instance applying the limits of the plan
+	Create(si ServiceInstance, plan Plan) error
+	// Destroy stops the instance and removes its data
+	Destroy(si ServiceInstance) error
+	// Describe returns the connection details and state of the instance
+	Describe(si ServiceInstance) (InstanceDetails, error)
+	// Update applies the limits of a new plan to a running instance
+	Update(si ServiceInstance, plan Plan, logger *slog.Logger) error
+	// CreateRole adds a login role with full privileges on the instance's
+	// database, used for service bindings
+	CreateRole(si ServiceInstance, username string, password string) error
+	// DropRole removes a role created by CreateRole, objects owned by the
+	// role are kept
+	DropRole(si ServiceInstance, username string) error
+	// Usage measures the resources consumed by the instance and reports the
+	// server version
+	Usage(si ServiceInstance) (InstanceUsage, error)
+	// RevokeWrite revokes INSERT, UPDATE and CREATE privileges from the
+	// roles, used when the instance exceeds its storage quota
+	RevokeWrite(si ServiceInstance, roles []string) error
+	// GrantWrite restores the privileges removed by RevokeWrite
+	GrantWrite(si ServiceInstance, roles []string) error
+	// SetAdminPassword replaces the password of the instance's superuser,
+	// si holds the current password
+	SetAdminPassword(si ServiceInstance, password string) error
+	// Ping checks the backend is reachable and responding
+	Ping() error
+	// NeedsPort reports whether every instance listens on its own port of
+	// the broker's port range, forwarded to the instance when it has a
+	// Target
+	NeedsPort() bool
+}
+
+// InstanceDetails type holds the data reported by a Provisioner about a
+// service instance
+type InstanceDetails struct {
+	Host     string
+	Port     int
+	Database string
+	Running  bool
+	// Target is the internal "ip:port" address of a running instance which
+	// Port must be forwarded to, empty when the instance is reachable on
+	// Host and Port without forwarding
+	Target string
+}
+
+// InstanceUsage type holds the resources consumed by a service instance
+type InstanceUsage struct {
+	SizeBytes int64
+	// Connections open to the instance's database
+	Connections int
+	// Version of the PostgreSQL server running the instance
+	Version string
+}
+
+// revokeWriteStatements returns the statements revoking write privileges on
+// database from the roles
+func revokeWriteStatements(database string, roles []string) string {
+	var s string
+	for _, role := range roles {
+		s += "REVOKE CREATE ON DATABASE " + database + " FROM " + role + "; " +
+			"REVOKE CREATE ON SCHEMA public FROM " + role + "; " +
+			"REVOKE INSERT, UPDATE ON ALL TABLES IN SCHEMA public FROM " + role + "; "
+	}
+	return s
+}
+
+// grantWriteStatements returns the statements restoring the privileges
+// revoked by revokeWriteStatements
+func grantWriteStatements(database string, roles []string) string {
+	var s string
+	for _, role := range roles {
+		s += "GRANT CREATE ON DATABASE " + database + " TO " + role + "; " +
+			"GRANT CREATE ON SCHEMA public TO " + role + "; " +
+			"GRANT INSERT, UPDATE ON ALL TABLES IN SCHEMA public TO " + role + "; "
+	}
+	return s
+}
+
+// Available provisioner backends
+const (
+	ProvisionerDocker  = "docker"
+	ProvisionerCluster = "cluster"
+	ProvisionerMemory  = "memory"
+)
+
+// ProvisionerConfig holds the settings used to build a provisioner backend
+type ProvisionerConfig struct {
+	// Name of the backend
+	Name string
+	// Host is the address applications use to reach provisioned instances,
+	// when empty each backend picks its default
+	Host string
+	// DockerSocket is the unix socket of the Docker Engine used by the
+	// docker backend
+	DockerSocket string
+	// ClusterURL is the postgres:// URL of the shared server used by the
+	// cluster backend
+	ClusterURL string
+	// Forwarding is the port forwarding mode, the docker backend publishes
+	// the ports of its containers with ForwardingDocker
+	Forwarding string
+}
+
+// NewProvisioner returns the provisioner backend described by the config
+func NewProvisioner(c ProvisionerConfig) (Provisioner, error) {
+	switch c.Name {
+	case ProvisionerDocker:
+		host := c.Host
+		if host == "" {
+			host = "localhost"
+		}
+		socket := c.DockerSocket
+		if socket == "" {
+			socket = DefaultDockerSocket
+		}
+		p := NewDockerProvisioner(socket, host)
+		p.PublishPorts = c.Forwarding == ForwardingDocker
+		return p, nil
+	case ProvisionerCluster:
+		if c.ClusterURL == "" {
+			return nil, fmt.Errorf("provisioner %q requires a cluster URL", c.Name)
+		}
+		return NewClusterProvisioner(c.ClusterURL, c.Host)
+	case ProvisionerMemory:
+		return NewMemoryProvisioner(), nil
+	default:
+		return nil, fmt.Errorf("unknown provisioner %q", c.Name)
+	}
+}
+
+// memoryVersion is the server version reported by MemoryProvisioner
+const memoryVersion = "memory"
+
+// MemoryProvisioner is an in-memory fake backend, instances only exist as
+// records in a map. It is meant for tests and environments without docker
+type MemoryProvisioner struct {
+	mutex     sync.Mutex
+	instances map[string]*memoryInstance
+}
+
+type memoryInstance struct {
+	plan          Plan
+	adminPassword string
+	roles         map[string]string
+	readOnly      map[string]bool
+	size          int64
+	target        string
+}
+
+// NewMemoryProvisioner returns an empty MemoryProvisioner
+func NewMemoryProvisioner() *MemoryProvisioner {
+	return &MemoryProvisioner{instances: make(map[string]*memoryInstance)}
+}
+
+// Create registers the instance, fails if it already exists
+func (p *MemoryProvisioner) Create(si ServiceInstance, plan Plan) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.instances[si.ID]; ok {
+		return fmt.Errorf("instance %s already exists", si.ID)
+	}
+	p.instances[si.ID] = &memoryInstance{
+		plan:          plan,
+		adminPassword: si.AdminPassword,
+		roles:         make(map[string]string),
+		readOnly:      make(map[string]bool),
+	}
+	return nil
+}
+
+// Destroy removes the instance, destroying an inexistent instance succeeds
+func (p *MemoryProvisioner) Destroy(si ServiceInstance) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.instances, si.ID)
+	return nil
+}
+
+// Describe reports the instance as running on localhost, forwarded from the
+// address set with SetTarget
+func (p *MemoryProvisioner) Describe(si ServiceInstance) (InstanceDetails, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	d := InstanceDetails{
+		Host:     "localhost",
+		Port:     si.Port,
+		Database: defaultDatabase,
+		Running:  ok,
+	}
+	if ok {
+		d.Target = i.target
+	}
+	return d, nil
+}
+
+// Update records the new plan of the instance
+func (p *MemoryProvisioner) Update(si ServiceInstance, plan Plan, logger *slog.Logger) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	i.plan = plan
+	return nil
+}
+
+// CreateRole records the role on the instance
+func (p *MemoryProvisioner) CreateRole(si ServiceInstance, username string, password string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	if _, ok := i.roles[username]; ok {
+		return fmt.Errorf("role %s already exists", username)
+	}
+	i.roles[username] = password
+	return nil
+}
+
+// DropRole removes the role from the instance
+func (p *MemoryProvisioner) DropRole(si ServiceInstance, username string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	delete(i.roles, username)
+	return nil
+}
+
+// Usage reports the size set with SetSize, memory instances have no
+// connections
+func (p *MemoryProvisioner) Usage(si ServiceInstance) (InstanceUsage, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return InstanceUsage{}, fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	return InstanceUsage{SizeBytes: i.size, Version: memoryVersion}, nil
+}
+
+// Ping always succeeds, instances are held in memory
+func (p *MemoryProvisioner) Ping() error {
+	return nil
+}
+
+// NeedsPort is true, instances are described on their allocated port
+func (p *MemoryProvisioner) NeedsPort() bool {
+	return true
+}
+
+// RevokeWrite marks the roles as read only
+func (p *MemoryProvisioner) RevokeWrite(si ServiceInstance, roles []string) error {
+	return p.setReadOnly(si, roles, true)
+}
+
+// GrantWrite marks the roles as writable
+func (p *MemoryProvisioner) GrantWrite(si ServiceInstance, roles []string) error {
+	return p.setReadOnly(si, roles, false)
+}
+
+func (p *MemoryProvisioner) setReadOnly(si ServiceInstance, roles []string, readOnly bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	for _, role := range roles {
+		i.readOnly[role] = readOnly
+	}
+	return nil
+}
+
+// SetAdminPassword records the new password of the instance's superuser
+func (p *MemoryProvisioner) SetAdminPassword(si ServiceInstance, password string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	i, ok := p.instances[si.ID]
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", si.ID)
+	}
+	i.adminPassword = password
+	return nil
+}
+
+// AdminPassword returns the password of the instance's superuser
+func (p *MemoryProvisioner) AdminPassword(instance string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if i, ok := p.instances[instance]; ok {
+		return i.adminPassword
+	}
+	return ""
+}
+
+// SetSize sets the size reported by Usage for the instance, it allows tests
+// to simulate data growth
+func (p *MemoryProvisioner) SetSize(instance string, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if i, ok := p.instances[instance]; ok {
+		i.size = bytes
+	}
+}
+
+// SetTarget sets the target reported by Describe for the instance, it allows
+// tests to simulate instances running on internal addresses
+func (p *MemoryProvisioner) SetTarget(instance string, target string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if i, ok := p.instances[instance]; ok {
+		i.target = target
+	}
+}
+
+// ReadOnly reports whether write privileges of the role were revoked
+func (p *MemoryProvisioner) ReadOnly(instance string, role string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if i, ok := p.instances[instance]; ok {
+		return i.readOnly[role]
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"time"
+)
+
+const bytesPerMB = 1024 * 1024
+
+// quotaExceededDescription is appended to the descriptions reported for
+// instances exceeding their storage quota
+const quotaExceededDescription = "storage quota exceeded, write privileges revoked until usage drops"
+
+// MonitorQuotas checks the storage quotas of every instance each interval
+// until stop is closed
+func (h *DbHandler) MonitorQuotas(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := h.CheckQuotas()
+			if err != nil {
+				h.logger().Error("quota check failed", "error", err)
+			}
+		}
+	}
+}
+
+// CheckQuotas compares the size of every instance against the storage quota
+// of its plan. Write privileges of bound roles are revoked from instances
+// going over quota and restored once usage drops below it
+func (h *DbHandler) CheckQuotas() error {
+	instances, err := h.Store.ListInstances()
+	if err != nil {
+		return err
+	}
+	for _, si := range instances {
+		err = h.checkQuota(si)
+		if err != nil {
+			// A failing instance must not prevent checking the others
+			h.logger().Warn("quota check of the instance failed", "instance_id", si.ID,
+				"plan_id", si.PlanID, "error", err)
+		}
+	}
+	return nil
+}
+
+func (h *DbHandler) checkQuota(si ServiceInstance) error {
+	plan, ok := h.findPlan(si.PlanID)
+	if !ok || plan.Limits.StorageMB == 0 {
+		return nil // no quota to enforce
+	}
+	usage, err := h.Provisioner.Usage(si)
+	if err != nil {
+		return err
+	}
+
+	exceeded := usage.SizeBytes > plan.Limits.StorageMB*bytesPerMB
+	if exceeded == si.QuotaExceeded {
+		return nil
+	}
+	// Other brokers sharing the store may be checking the same instance, the
+	// roles are read under the instance lock so they match the recorded state
+	return h.Store.ModifyInstance(si.ID, func(si *ServiceInstance) error {
+		if exceeded == si.QuotaExceeded {
+			return nil
+		}
+		roles, err := h.BindingRoles(si.ID)
+		if err != nil {
+			return err
+		}
+		if exceeded {
+			h.logger().Warn("instance over quota, revoking write privileges", "instance_id", si.ID,
+				"plan_id", si.PlanID, "usage_mb", usage.SizeBytes/bytesPerMB, "quota_mb", plan.Limits.StorageMB)
+			err = h.Provisioner.RevokeWrite(*si, roles)
+		} else {
+			h.logger().Info("instance back under quota, restoring write privileges", "instance_id", si.ID,
+				"plan_id", si.PlanID)
+			err = h.Provisioner.GrantWrite(*si, roles)
+		}
+		if err != nil {
+			return err
+		}
+		si.QuotaExceeded = exceeded
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"testing"
+)
+
+func TestCheckQuotas(t *testing.T) {
+	const (
+		planID    = "83c8811b-f3db-17ef-6eb3-bbe944b47262" // 5mb plan
+		bindingID = "6ab4f79b-6f4c-4b8b-9c1a-1d1f0f1e2a3b"
+	)
+	provisioner := NewMemoryProvisioner()
+	dbhandler := DbHandler{Store: NewMemoryStore(), Provisioner: provisioner}
+
+	_, err := dbhandler.Add(testID, ProvisionRequest{PlanID: planID}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbhandler.Remove(testID)
+	sb, err := dbhandler.AddBinding(testID, bindingID, BindRequest{}, dbhandler.logger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// within quota nothing changes
+	provisioner.SetSize(testID, 4*bytesPerMB)
+	err = dbhandler.CheckQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provisioner.ReadOnly(testID, sb.Username) {
+		t.Error("Role made read only within quota")
+	}
+
+	// over quota write privileges are revoked
+	provisioner.SetSize(testID, 6*bytesPerMB)
+	err = dbhandler.CheckQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, err := dbhandler.Store.GetInstance(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !si.QuotaExceeded || !provisioner.ReadOnly(testID, sb.Username) {
+		t.Error("Write privileges not revoked over quota")
+	}
+
+	// back under quota write privileges are restored
+	provisioner.SetSize(testID, 1*bytesPerMB)
+	err = dbhandler.CheckQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	si, err = dbhandler.Store.GetInstance(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.QuotaExceeded || provisioner.ReadOnly(testID, sb.Username) {
+		t.Error("Write privileges not restored under quota")
+	}
+}
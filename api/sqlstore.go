@@ -0,0 +1,677 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Blank import according to go-sqlite3's instructions
+)
+
+// Drivers supported by SQLStore
+const (
+	StoreSQLite   = "sqlite3"
+	StorePostgres = "postgres"
+)
+
+const (
+	table          = "service_instance"
+	bindingTable   = "service_binding"
+	operationTable = "operation"
+	portTable      = "port"
+	forwardTable   = "forward_rule"
+)
+
+// allocateAttempts bounds the retries of AllocatePort when another broker
+// sharing the database allocates the same port
+const allocateAttempts = 5
+
+// instanceColumns are the columns read by scanInstance
+const instanceColumns = "id, service, port, info, COALESCE(plan_id, ''), COALESCE(quota_exceeded, 0), " +
+	"COALESCE(service_id, ''), COALESCE(organization_guid, ''), COALESCE(space_guid, ''), " +
+	"COALESCE(admin_password, ''), COALESCE(key_id, ''), COALESCE(parameters, '')"
+
+// SQLStore is a Store keeping the state in a SQL database. Every statement is
+// parameterized and runs on a connection pool opened once for the lifetime of
+// the store.
+//
+// A PostgreSQL database can be shared by several brokers, instances are
+// modified with their row locked. A sqlite database belongs to a single
+// broker.
+//
+// Admin passwords of instances and passwords of bindings are encrypted with
+// the keyring set with SetKeyring, rows record the ID of the master key
+type SQLStore struct {
+	driver  string
+	db      *sql.DB
+	keyring *Keyring
+	// mutex serializes ModifyInstance on drivers without row locks
+	mutex sync.Mutex
+}
+
+// NewSQLStore opens the database identified by dataSource with one of the
+// supported drivers, a file path for sqlite3 or a connection URL for
+// postgres. Migrate must be called before using the store
+func NewSQLStore(driver string, dataSource string) (*SQLStore, error) {
+	if driver != StoreSQLite && driver != StorePostgres {
+		return nil, fmt.Errorf("unknown state store driver %q", driver)
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if driver == StoreSQLite {
+		// sqlite does not support concurrent writers, a single connection
+		// serializes the statements of handlers and background operations
+		db.SetMaxOpenConns(1)
+	}
+	return &SQLStore{driver: driver, db: db}, nil
+}
+
+// NewSQLiteStore opens the sqlite database at path, Migrate must be called
+// before using the store
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	return NewSQLStore(StoreSQLite, path)
+}
+
+// SetKeyring sets the keyring encrypting the secrets of the store
+func (s *SQLStore) SetKeyring(k *Keyring) {
+	s.keyring = k
+}
+
+// encrypt encrypts a secret with the keyring of the store, returns the
+// encrypted secret and the ID of the master key. Empty secrets are kept empty
+func (s *SQLStore) encrypt(secret string) (string, string, error) {
+	if secret == "" {
+		return "", "", nil
+	}
+	if s.keyring == nil {
+		return "", "", errNoStateKey
+	}
+	return s.keyring.Encrypt(secret)
+}
+
+// decrypt decrypts a secret encrypted by encrypt, secrets stored before
+// envelope encryption have no key ID and are opened with legacy
+func (s *SQLStore) decrypt(secret string, keyID string, legacy func(string) (string, error)) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	if keyID == "" && legacy != nil {
+		return legacy(secret)
+	}
+	if s.keyring == nil {
+		return "", errNoStateKey
+	}
+	return s.keyring.Decrypt(secret, keyID)
+}
+
+// decryptUnwrapped opens the admin passwords encrypted directly with the
+// state key
+func (s *SQLStore) decryptUnwrapped(secret string) (string, error) {
+	if s.keyring == nil {
+		return "", errNoStateKey
+	}
+	return s.keyring.decryptUnwrapped(secret)
+}
+
+// plaintext returns the binding passwords stored before they were encrypted
+func plaintext(secret string) (string, error) {
+	return secret, nil
+}
+
+// rebind rewrites the ? placeholders of a query to the syntax of the driver
+func (s *SQLStore) rebind(query string) string {
+	if s.driver != StorePostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// boolToInt converts flags stored on INTEGER columns, drivers differ on how
+// they bind booleans
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// scanner is implemented by sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanInstance reads a service instance selected with instanceColumns
+func (s *SQLStore) scanInstance(row scanner) (ServiceInstance, error) {
+	var si ServiceInstance
+	var adminPassword, keyID string
+	err := row.Scan(&si.ID, &si.Service, &si.Port, &si.Info, &si.PlanID, &si.QuotaExceeded,
+		&si.ServiceID, &si.OrganizationGUID, &si.SpaceGUID, &adminPassword, &keyID, &si.Parameters)
+	if err != nil {
+		return ServiceInstance{}, err
+	}
+	si.AdminPassword, err = s.decrypt(adminPassword, keyID, s.decryptUnwrapped)
+	if err != nil {
+		return ServiceInstance{}, fmt.Errorf("admin password of %s: %v", si.ID, err)
+	}
+	return si, nil
+}
+
+// CreateInstance registers a new instance
+func (s *SQLStore) CreateInstance(si ServiceInstance) error {
+	adminPassword, keyID, err := s.encrypt(si.AdminPassword)
+	if err != nil {
+		return err
+	}
+	insertQuery := "INSERT INTO " + table +
+		"(id, service, port, info, plan_id, quota_exceeded, service_id, organization_guid, space_guid, " +
+		"admin_password, key_id, parameters) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	_, err = s.db.Exec(s.rebind(insertQuery), si.ID, si.Service, si.Port, si.Info, si.PlanID, boolToInt(si.QuotaExceeded),
+		si.ServiceID, si.OrganizationGUID, si.SpaceGUID, adminPassword, keyID, si.Parameters)
+	if err != nil {
+		// The ID is the primary key, concurrent requests for the same
+		// instance fail to insert
+		if _, e := s.GetInstance(si.ID); e == nil {
+			return ErrInstanceExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetInstance returns a registered instance
+func (s *SQLStore) GetInstance(id string) (ServiceInstance, error) {
+	query := "SELECT " + instanceColumns + " FROM " + table + " WHERE id = ?;"
+	si, err := s.scanInstance(s.db.QueryRow(s.rebind(query), id))
+	if err == sql.ErrNoRows {
+		return ServiceInstance{}, ErrInstanceNotFound
+	}
+	if err != nil {
+		return ServiceInstance{}, err
+	}
+	return si, nil
+}
+
+// ListInstances returns every registered instance
+func (s *SQLStore) ListInstances() ([]ServiceInstance, error) {
+	rows, err := s.db.Query("SELECT " + instanceColumns + " FROM " + table + ";")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var instances []ServiceInstance
+	for rows.Next() {
+		si, err := s.scanInstance(rows)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, si)
+	}
+	return instances, rows.Err()
+}
+
+// UpdateInstance records the attributes of a registered instance
+func (s *SQLStore) UpdateInstance(si ServiceInstance) error {
+	return s.updateInstance(s.db, si)
+}
+
+// execer is implemented by sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLStore) updateInstance(e execer, si ServiceInstance) error {
+	adminPassword, keyID, err := s.encrypt(si.AdminPassword)
+	if err != nil {
+		return err
+	}
+	updateQuery := "UPDATE " + table + " SET service = ?, port = ?, info = ?, plan_id = ?, quota_exceeded = ?, " +
+		"service_id = ?, organization_guid = ?, space_guid = ?, admin_password = ?, key_id = ?, parameters = ? " +
+		"WHERE id = ?;"
+	res, err := e.Exec(s.rebind(updateQuery), si.Service, si.Port, si.Info, si.PlanID, boolToInt(si.QuotaExceeded),
+		si.ServiceID, si.OrganizationGUID, si.SpaceGUID, adminPassword, keyID, si.Parameters, si.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrInstanceNotFound
+	}
+	return nil
+}
+
+// ModifyInstance reads the instance, calls modify and records the modified
+// instance. On PostgreSQL the instance's row is locked meanwhile so brokers
+// sharing the database wait for each other. modify must not use the store
+func (s *SQLStore) ModifyInstance(id string, modify func(si *ServiceInstance) error) error {
+	if s.driver != StorePostgres {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		si, err := s.GetInstance(id)
+		if err != nil {
+			return err
+		}
+		err = modify(&si)
+		if err != nil {
+			return err
+		}
+		return s.UpdateInstance(si)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	query := "SELECT " + instanceColumns + " FROM " + table + " WHERE id = ? FOR UPDATE;"
+	si, err := s.scanInstance(tx.QueryRow(s.rebind(query), id))
+	if err == sql.ErrNoRows {
+		return ErrInstanceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = modify(&si)
+	if err != nil {
+		return err
+	}
+	err = s.updateInstance(tx, si)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteInstance removes the instance along with its bindings and forward
+// rule
+func (s *SQLStore) DeleteInstance(id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer rollback(tx)
+
+	_, err = tx.Exec(s.rebind("DELETE FROM "+bindingTable+" WHERE instance_id = ?;"), id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(s.rebind("DELETE FROM "+portTable+" WHERE instance_id = ?;"), id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(s.rebind("DELETE FROM "+forwardTable+" WHERE instance_id = ?;"), id)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(s.rebind("DELETE FROM "+table+" WHERE id = ?;"), id)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := res.RowsAffected()
+	return rows > 0, tx.Commit()
+}
+
+// AllocatePort reserves the lowest free port of the range for the instance.
+// Ports are the primary key of their table, when another broker inserts the
+// same port first the allocation is retried
+func (s *SQLStore) AllocatePort(instance string, r PortRange) (int, error) {
+	var err error
+	for i := 0; i < allocateAttempts; i++ {
+		var port int
+		port, err = s.allocatePort(instance, r)
+		if err == nil || err == ErrNoPortAvailable {
+			return port, err
+		}
+	}
+	return 0, err
+}
+
+func (s *SQLStore) allocatePort(instance string, r PortRange) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer rollback(tx)
+
+	query := "SELECT port FROM " + portTable + " WHERE port >= ? AND port <= ? ORDER BY port;"
+	rows, err := tx.Query(s.rebind(query), r.Min, r.Max)
+	if err != nil {
+		return 0, err
+	}
+	// Ports are sorted, the first gap is the lowest free port
+	port := r.Min
+	for rows.Next() {
+		var allocated int
+		err = rows.Scan(&allocated)
+		if err != nil {
+			closeRows(rows)
+			return 0, err
+		}
+		if allocated != port {
+			break
+		}
+		port++
+	}
+	closeRows(rows)
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if port > r.Max {
+		return 0, ErrNoPortAvailable
+	}
+
+	_, err = tx.Exec(s.rebind("INSERT INTO "+portTable+"(port, instance_id) VALUES(?, ?);"), port, instance)
+	if err != nil {
+		return 0, err
+	}
+	return port, tx.Commit()
+}
+
+// ReleasePort frees an allocated port
+func (s *SQLStore) ReleasePort(port int) error {
+	_, err := s.db.Exec(s.rebind("DELETE FROM "+portTable+" WHERE port = ?;"), port)
+	return err
+}
+
+// CountPorts returns the number of allocated ports of the range
+func (s *SQLStore) CountPorts(r PortRange) (int, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM " + portTable + " WHERE port >= ? AND port <= ?;"
+	err := s.db.QueryRow(s.rebind(query), r.Min, r.Max).Scan(&count)
+	return count, err
+}
+
+// SaveForwardRule records the forward rule of an instance
+func (s *SQLStore) SaveForwardRule(rule ForwardRule) error {
+	upsertQuery := "INSERT INTO " + forwardTable + "(instance_id, port, target) VALUES(?, ?, ?) " +
+		"ON CONFLICT(instance_id) DO UPDATE SET port = excluded.port, target = excluded.target;"
+	_, err := s.db.Exec(s.rebind(upsertQuery), rule.InstanceID, rule.Port, rule.Target)
+	return err
+}
+
+// GetForwardRule returns the forward rule of an instance
+func (s *SQLStore) GetForwardRule(instance string) (ForwardRule, error) {
+	rule := ForwardRule{InstanceID: instance}
+	query := "SELECT port, target FROM " + forwardTable + " WHERE instance_id = ?;"
+	err := s.db.QueryRow(s.rebind(query), instance).Scan(&rule.Port, &rule.Target)
+	if err == sql.ErrNoRows {
+		return ForwardRule{}, ErrForwardRuleNotFound
+	}
+	if err != nil {
+		return ForwardRule{}, err
+	}
+	return rule, nil
+}
+
+// ListForwardRules returns the forward rules of every instance
+func (s *SQLStore) ListForwardRules() ([]ForwardRule, error) {
+	rows, err := s.db.Query("SELECT instance_id, port, target FROM " + forwardTable + ";")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var rules []ForwardRule
+	for rows.Next() {
+		var rule ForwardRule
+		err = rows.Scan(&rule.InstanceID, &rule.Port, &rule.Target)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// CreateBinding registers a new binding
+func (s *SQLStore) CreateBinding(sb ServiceBinding) error {
+	password, keyID, err := s.encrypt(sb.Password)
+	if err != nil {
+		return err
+	}
+	insertQuery := "INSERT INTO " + bindingTable + "(id, instance_id, username, password, key_id, parameters) " +
+		"VALUES(?, ?, ?, ?, ?, ?);"
+	_, err = s.db.Exec(s.rebind(insertQuery), sb.ID, sb.InstanceID, sb.Username, password, keyID, sb.Parameters)
+	return err
+}
+
+// bindingColumns are the columns read by scanBinding
+const bindingColumns = "id, instance_id, username, COALESCE(password, ''), COALESCE(key_id, ''), " +
+	"COALESCE(parameters, '')"
+
+// scanBinding reads a service binding selected with bindingColumns
+func (s *SQLStore) scanBinding(row scanner) (ServiceBinding, error) {
+	var sb ServiceBinding
+	var password, keyID string
+	err := row.Scan(&sb.ID, &sb.InstanceID, &sb.Username, &password, &keyID, &sb.Parameters)
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+	sb.Password, err = s.decrypt(password, keyID, plaintext)
+	if err != nil {
+		return ServiceBinding{}, fmt.Errorf("password of binding %s: %v", sb.ID, err)
+	}
+	return sb, nil
+}
+
+// GetBinding returns a registered binding
+func (s *SQLStore) GetBinding(id string) (ServiceBinding, error) {
+	query := "SELECT " + bindingColumns + " FROM " + bindingTable + " WHERE id = ?;"
+	sb, err := s.scanBinding(s.db.QueryRow(s.rebind(query), id))
+	if err == sql.ErrNoRows {
+		return ServiceBinding{}, ErrBindingNotFound
+	}
+	if err != nil {
+		return ServiceBinding{}, err
+	}
+	return sb, nil
+}
+
+// ListBindings returns the bindings of the instance
+func (s *SQLStore) ListBindings(instance string) ([]ServiceBinding, error) {
+	query := "SELECT " + bindingColumns + " FROM " + bindingTable + " WHERE instance_id = ?;"
+	rows, err := s.db.Query(s.rebind(query), instance)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var bindings []ServiceBinding
+	for rows.Next() {
+		sb, err := s.scanBinding(rows)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, sb)
+	}
+	return bindings, rows.Err()
+}
+
+// DeleteBinding removes a binding
+func (s *SQLStore) DeleteBinding(id string) (bool, error) {
+	res, err := s.db.Exec(s.rebind("DELETE FROM "+bindingTable+" WHERE id = ?;"), id)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := res.RowsAffected()
+	return rows > 0, nil
+}
+
+// CreateOperation registers a new operation
+func (s *SQLStore) CreateOperation(op Operation) error {
+	insertQuery := "INSERT INTO " + operationTable + "(id, instance_id, type, state, description, created) " +
+		"VALUES(?, ?, ?, ?, ?, ?);"
+	_, err := s.db.Exec(s.rebind(insertQuery), op.ID, op.InstanceID, op.Type, op.State, op.Description,
+		time.Now().UnixNano())
+	return err
+}
+
+// GetOperation returns an operation of the instance, the latest one when id
+// is empty
+func (s *SQLStore) GetOperation(instance string, id string) (Operation, error) {
+	query := "SELECT id, instance_id, type, state, description FROM " + operationTable +
+		" WHERE instance_id = ?"
+	args := []interface{}{instance}
+	if id != "" {
+		query += " AND id = ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY created DESC LIMIT 1;"
+
+	var op Operation
+	err := s.db.QueryRow(s.rebind(query), args...).Scan(&op.ID, &op.InstanceID, &op.Type, &op.State, &op.Description)
+	if err == sql.ErrNoRows {
+		return Operation{}, ErrOperationNotFound
+	}
+	if err != nil {
+		return Operation{}, err
+	}
+	return op, nil
+}
+
+// UpdateOperation records the state and description of an operation
+func (s *SQLStore) UpdateOperation(id string, state string, description string) error {
+	_, err := s.db.Exec(s.rebind("UPDATE "+operationTable+" SET state = ?, description = ? WHERE id = ?;"),
+		state, description, id)
+	return err
+}
+
+// RotateKeys re-encrypts every secret which is not encrypted with the
+// current master key of the keyring, secrets stored before envelope
+// encryption included. Returns the number of re-encrypted secrets
+func (s *SQLStore) RotateKeys() (int, error) {
+	if s.keyring == nil {
+		return 0, errNoStateKey
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer rollback(tx)
+
+	rotated := 0
+	for _, secrets := range []struct {
+		table  string
+		column string
+		legacy func(string) (string, error)
+	}{
+		{table, "admin_password", s.decryptUnwrapped},
+		{bindingTable, "password", plaintext},
+	} {
+		n, err := s.rotateKeys(tx, secrets.table, secrets.column, secrets.legacy)
+		if err != nil {
+			return 0, err
+		}
+		rotated += n
+	}
+	return rotated, tx.Commit()
+}
+
+// rotateKeys re-encrypts the secrets stored on a column of a table
+func (s *SQLStore) rotateKeys(tx *sql.Tx, tableName string, column string,
+	legacy func(string) (string, error)) (int, error) {
+	query := "SELECT id, " + column + ", COALESCE(key_id, '') FROM " + tableName +
+		" WHERE " + column + " <> '' AND COALESCE(key_id, '') <> ?"
+	if s.driver == StorePostgres {
+		query += " FOR UPDATE" // brokers sharing the database keep writing
+	}
+	rows, err := tx.Query(s.rebind(query+";"), s.keyring.KeyID())
+	if err != nil {
+		return 0, err
+	}
+	type secret struct{ id, value, keyID string }
+	var secrets []secret
+	for rows.Next() {
+		var sec secret
+		err = rows.Scan(&sec.id, &sec.value, &sec.keyID)
+		if err != nil {
+			closeRows(rows)
+			return 0, err
+		}
+		secrets = append(secrets, sec)
+	}
+	closeRows(rows)
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updateQuery := "UPDATE " + tableName + " SET " + column + " = ?, key_id = ? WHERE id = ?;"
+	for _, sec := range secrets {
+		value, err := s.decrypt(sec.value, sec.keyID, legacy)
+		if err != nil {
+			return 0, fmt.Errorf("%s of %s: %v", column, sec.id, err)
+		}
+		value, keyID, err := s.encrypt(value)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(s.rebind(updateQuery), value, keyID, sec.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(secrets), nil
+}
+
+// Ping checks a connection to the state database can be established
+func (s *SQLStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close closes the connection pool
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// closeDB closes a database connection, logging failures
+func closeDB(db *sql.DB) {
+	e := db.Close()
+	if e != nil {
+		slog.Warn("closing the database failed", "error", e)
+	}
+}
+
+// closeRows closes a result set, logging failures
+func closeRows(rows *sql.Rows) {
+	e := rows.Close()
+	if e != nil {
+		slog.Warn("closing the result set failed", "error", e)
+	}
+}
+
+// rollback aborts a transaction unless it was committed
+func rollback(tx *sql.Tx) {
+	e := tx.Rollback()
+	if e != nil && e != sql.ErrTxDone {
+		slog.Error("rolling back the transaction failed", "error", e)
+	}
+}
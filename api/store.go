@@ -0,0 +1,402 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors returned by Store implementations
+var (
+	// ErrInstanceNotFound is returned when a service instance is not
+	// registered
+	ErrInstanceNotFound = errors.New("service instance not found")
+	// ErrInstanceExists is returned when registering an instance ID which is
+	// already registered
+	ErrInstanceExists = errors.New("service instance already exists")
+	// ErrBindingNotFound is returned when a service binding is not
+	// registered
+	ErrBindingNotFound = errors.New("service binding not found")
+	// ErrOperationNotFound is returned when an instance has no matching
+	// operation
+	ErrOperationNotFound = errors.New("operation not found")
+	// ErrNoPortAvailable is returned when every port of the range is
+	// allocated
+	ErrNoPortAvailable = errors.New("no port available")
+	// ErrForwardRuleNotFound is returned when an instance has no port
+	// forwarding rule
+	ErrForwardRuleNotFound = errors.New("forward rule not found")
+)
+
+// PortRange is an inclusive range of ports allocated to service instances
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// DefaultPortRange is used when no port range is configured
+var DefaultPortRange = PortRange{Min: 5432, Max: 6431}
+
+// ParsePortRange parses a "min-max" port range
+func ParsePortRange(s string) (PortRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return PortRange{}, fmt.Errorf("port range %q must be formatted as min-max", s)
+	}
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q: %v", s, err)
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q: %v", s, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("port range %q must be within 1-65535 with min <= max", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// String formats the range as parsed by ParsePortRange
+func (r PortRange) String() string {
+	return strconv.Itoa(r.Min) + "-" + strconv.Itoa(r.Max)
+}
+
+// Store keeps the state of the broker: service instances, their bindings and
+// the asynchronous operations executed over them
+type Store interface {
+	// CreateInstance registers a new instance, returns ErrInstanceExists if
+	// the ID is already registered
+	CreateInstance(si ServiceInstance) error
+	// GetInstance returns ErrInstanceNotFound if the instance does not exist
+	GetInstance(id string) (ServiceInstance, error)
+	ListInstances() ([]ServiceInstance, error)
+	// UpdateInstance records the attributes of a registered instance
+	UpdateInstance(si ServiceInstance) error
+	// ModifyInstance reads the instance, calls modify and records the
+	// modified instance, concurrent modifications of the instance wait for
+	// each other. modify may read the store and record other entities but
+	// must not modify the instance through the store
+	ModifyInstance(id string, modify func(si *ServiceInstance) error) error
+	// DeleteInstance removes the instance along with its bindings and
+	// forward rule and releases its ports, returns false if the instance
+	// does not exist
+	DeleteInstance(id string) (bool, error)
+
+	// AllocatePort reserves the lowest free port of the range for the
+	// instance, returns ErrNoPortAvailable if every port is allocated
+	AllocatePort(instance string, r PortRange) (int, error)
+	// ReleasePort frees a port allocated by AllocatePort
+	ReleasePort(port int) error
+	// CountPorts returns the number of allocated ports of the range
+	CountPorts(r PortRange) (int, error)
+
+	// SaveForwardRule records the forward rule of an instance, replacing
+	// any previous rule of the instance
+	SaveForwardRule(rule ForwardRule) error
+	// GetForwardRule returns ErrForwardRuleNotFound if the instance has no
+	// forward rule
+	GetForwardRule(instance string) (ForwardRule, error)
+	ListForwardRules() ([]ForwardRule, error)
+
+	CreateBinding(sb ServiceBinding) error
+	// GetBinding returns ErrBindingNotFound if the binding does not exist
+	GetBinding(id string) (ServiceBinding, error)
+	ListBindings(instance string) ([]ServiceBinding, error)
+	// DeleteBinding returns false if the binding does not exist
+	DeleteBinding(id string) (bool, error)
+
+	CreateOperation(op Operation) error
+	// GetOperation returns an operation of the instance, the latest one when
+	// id is empty. Returns ErrOperationNotFound if there is no matching
+	// operation
+	GetOperation(instance string, id string) (Operation, error)
+	// UpdateOperation records the state and description of an operation
+	UpdateOperation(id string, state string, description string) error
+
+	// Ping checks the store is reachable
+	Ping() error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// MemoryStore is a Store keeping the state in memory, it is meant for tests
+type MemoryStore struct {
+	mutex      sync.Mutex
+	modifying  sync.Mutex // held by ModifyInstance
+	instances  map[string]ServiceInstance
+	bindings   map[string]ServiceBinding
+	ports      map[int]string // allocated ports to instance IDs
+	rules      map[string]ForwardRule
+	operations []Operation // in creation order
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		instances: make(map[string]ServiceInstance),
+		bindings:  make(map[string]ServiceBinding),
+		ports:     make(map[int]string),
+		rules:     make(map[string]ForwardRule),
+	}
+}
+
+// CreateInstance registers a new instance
+func (s *MemoryStore) CreateInstance(si ServiceInstance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.instances[si.ID]; ok {
+		return ErrInstanceExists
+	}
+	s.instances[si.ID] = si
+	return nil
+}
+
+// GetInstance returns a registered instance
+func (s *MemoryStore) GetInstance(id string) (ServiceInstance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	si, ok := s.instances[id]
+	if !ok {
+		return ServiceInstance{}, ErrInstanceNotFound
+	}
+	return si, nil
+}
+
+// ListInstances returns every registered instance
+func (s *MemoryStore) ListInstances() ([]ServiceInstance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var instances []ServiceInstance
+	for _, si := range s.instances {
+		instances = append(instances, si)
+	}
+	return instances, nil
+}
+
+// UpdateInstance records the attributes of a registered instance
+func (s *MemoryStore) UpdateInstance(si ServiceInstance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.instances[si.ID]; !ok {
+		return ErrInstanceNotFound
+	}
+	s.instances[si.ID] = si
+	return nil
+}
+
+// ModifyInstance reads the instance, calls modify and records the modified
+// instance
+func (s *MemoryStore) ModifyInstance(id string, modify func(si *ServiceInstance) error) error {
+	s.modifying.Lock()
+	defer s.modifying.Unlock()
+	si, err := s.GetInstance(id)
+	if err != nil {
+		return err
+	}
+	err = modify(&si)
+	if err != nil {
+		return err
+	}
+	return s.UpdateInstance(si)
+}
+
+// DeleteInstance removes the instance along with its bindings and forward
+// rule
+func (s *MemoryStore) DeleteInstance(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.instances[id]; !ok {
+		return false, nil
+	}
+	delete(s.instances, id)
+	delete(s.rules, id)
+	for bid, sb := range s.bindings {
+		if sb.InstanceID == id {
+			delete(s.bindings, bid)
+		}
+	}
+	for port, instance := range s.ports {
+		if instance == id {
+			delete(s.ports, port)
+		}
+	}
+	return true, nil
+}
+
+// AllocatePort reserves the lowest free port of the range for the instance
+func (s *MemoryStore) AllocatePort(instance string, r PortRange) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for port := r.Min; port <= r.Max; port++ {
+		if _, ok := s.ports[port]; !ok {
+			s.ports[port] = instance
+			return port, nil
+		}
+	}
+	return 0, ErrNoPortAvailable
+}
+
+// ReleasePort frees an allocated port
+func (s *MemoryStore) ReleasePort(port int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.ports, port)
+	return nil
+}
+
+// CountPorts returns the number of allocated ports of the range
+func (s *MemoryStore) CountPorts(r PortRange) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for port := range s.ports {
+		if port >= r.Min && port <= r.Max {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// SaveForwardRule records the forward rule of an instance
+func (s *MemoryStore) SaveForwardRule(rule ForwardRule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.instances[rule.InstanceID]; !ok {
+		return ErrInstanceNotFound
+	}
+	s.rules[rule.InstanceID] = rule
+	return nil
+}
+
+// GetForwardRule returns the forward rule of an instance
+func (s *MemoryStore) GetForwardRule(instance string) (ForwardRule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rule, ok := s.rules[instance]
+	if !ok {
+		return ForwardRule{}, ErrForwardRuleNotFound
+	}
+	return rule, nil
+}
+
+// ListForwardRules returns the forward rules of every instance
+func (s *MemoryStore) ListForwardRules() ([]ForwardRule, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var rules []ForwardRule
+	for _, rule := range s.rules {
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// CreateBinding registers a new binding
+func (s *MemoryStore) CreateBinding(sb ServiceBinding) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.instances[sb.InstanceID]; !ok {
+		return ErrInstanceNotFound
+	}
+	s.bindings[sb.ID] = sb
+	return nil
+}
+
+// GetBinding returns a registered binding
+func (s *MemoryStore) GetBinding(id string) (ServiceBinding, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sb, ok := s.bindings[id]
+	if !ok {
+		return ServiceBinding{}, ErrBindingNotFound
+	}
+	return sb, nil
+}
+
+// ListBindings returns the bindings of the instance
+func (s *MemoryStore) ListBindings(instance string) ([]ServiceBinding, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var bindings []ServiceBinding
+	for _, sb := range s.bindings {
+		if sb.InstanceID == instance {
+			bindings = append(bindings, sb)
+		}
+	}
+	return bindings, nil
+}
+
+// DeleteBinding removes a binding
+func (s *MemoryStore) DeleteBinding(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.bindings[id]; !ok {
+		return false, nil
+	}
+	delete(s.bindings, id)
+	return true, nil
+}
+
+// CreateOperation registers a new operation
+func (s *MemoryStore) CreateOperation(op Operation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.operations = append(s.operations, op)
+	return nil
+}
+
+// GetOperation returns an operation of the instance, the latest one when id
+// is empty
+func (s *MemoryStore) GetOperation(instance string, id string) (Operation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := len(s.operations) - 1; i >= 0; i-- {
+		op := s.operations[i]
+		if op.InstanceID == instance && (id == "" || op.ID == id) {
+			return op, nil
+		}
+	}
+	return Operation{}, ErrOperationNotFound
+}
+
+// UpdateOperation records the state and description of an operation
+func (s *MemoryStore) UpdateOperation(id string, state string, description string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.operations {
+		if s.operations[i].ID == id {
+			s.operations[i].State = state
+			s.operations[i].Description = description
+			return nil
+		}
+	}
+	return ErrOperationNotFound
+}
+
+// Ping always succeeds, the state is held in memory
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close does nothing, the state is kept until the store is garbage collected
+func (s *MemoryStore) Close() error {
+	return nil
+}
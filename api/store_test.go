@@ -0,0 +1,280 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeyring(testKeyring(t))
+	testStore(t, s)
+}
+
+// TestPostgresStore runs against the PostgreSQL database identified by the
+// STORE_TEST_POSTGRES_URL environment variable, skipped when unset
+func TestPostgresStore(t *testing.T) {
+	dataSource := os.Getenv("STORE_TEST_POSTGRES_URL")
+	if dataSource == "" {
+		t.Skip("STORE_TEST_POSTGRES_URL not set")
+	}
+	s, err := NewSQLStore(StorePostgres, dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeyring(testKeyring(t))
+	testStore(t, s)
+}
+
+// TestSQLiteStoreConcurrentPorts allocates ports concurrently, every
+// instance must get its own port
+func TestSQLiteStoreConcurrentPorts(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const instances = 20
+	ports := make(chan int, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			port, err := s.AllocatePort(strconv.Itoa(i), DefaultPortRange)
+			if err != nil {
+				t.Error(err)
+			}
+			ports <- port
+		}(i)
+	}
+	wg.Wait()
+	close(ports)
+	allocated := make(map[int]bool)
+	for port := range ports {
+		if allocated[port] {
+			t.Error("Port ", port, " allocated twice")
+		}
+		allocated[port] = true
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	r, err := ParsePortRange("5432-6431")
+	if err != nil || r != DefaultPortRange || r.String() != "5432-6431" {
+		t.Error("Unexpected port range ", r, err)
+	}
+	for _, s := range []string{"", "5432", "6431-5432", "0-10", "5432-70000", "a-b"} {
+		if _, err = ParsePortRange(s); err == nil {
+			t.Error("Invalid port range ", s, " accepted")
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE t SET a = ?, b = ? WHERE id = ?;"
+	s := &SQLStore{driver: StorePostgres}
+	if q := s.rebind(query); q != "UPDATE t SET a = $1, b = $2 WHERE id = $3;" {
+		t.Error("Unexpected postgres query ", q)
+	}
+	s = &SQLStore{driver: StoreSQLite}
+	if q := s.rebind(query); q != query {
+		t.Error("Unexpected sqlite query ", q)
+	}
+	if _, err := NewSQLStore("mysql", ""); err == nil {
+		t.Error("Unknown driver accepted")
+	}
+}
+
+// testStore validates the behavior shared by every Store implementation
+func testStore(t *testing.T, s Store) {
+	si := ServiceInstance{
+		ID:               testID,
+		Port:             5432,
+		Service:          "PostgreSQL",
+		PlanID:           "83c8811b-f3db-17ef-6eb3-bbe944b47262",
+		ServiceID:        "5c9e5f5a-7a59-4f1e-9a4b-3f2c7d1e8b60",
+		OrganizationGUID: testID,
+		SpaceGUID:        testID,
+		AdminPassword:    "admin-secret",
+		Parameters:       `{"locale":"en_US"}`,
+	}
+	if err := s.CreateInstance(si); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateInstance(si); err != ErrInstanceExists {
+		t.Error("Duplicated instance: expected ErrInstanceExists got ", err)
+	}
+	if _, err := s.GetInstance(inexistentID); err != ErrInstanceNotFound {
+		t.Error("Inexistent instance: expected ErrInstanceNotFound got ", err)
+	}
+
+	si.QuotaExceeded = true
+	if err := s.UpdateInstance(si); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetInstance(testID)
+	if err != nil || got != si {
+		t.Error("GetInstance: expected ", si, " got ", got, err)
+	}
+	err = s.ModifyInstance(testID, func(si *ServiceInstance) error {
+		si.QuotaExceeded = false
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("modification failed")
+	err = s.ModifyInstance(testID, func(si *ServiceInstance) error {
+		si.QuotaExceeded = true
+		return failure
+	})
+	if err != failure {
+		t.Error("ModifyInstance: expected modify error got ", err)
+	}
+	if got, _ = s.GetInstance(testID); got.QuotaExceeded {
+		t.Error("ModifyInstance: failed modification recorded")
+	}
+	si.QuotaExceeded = false
+
+	instances, err := s.ListInstances()
+	if err != nil || len(instances) != 1 {
+		t.Error("ListInstances: expected one instance got ", instances, err)
+	}
+
+	sb := ServiceBinding{ID: inexistentID, InstanceID: testID, Username: "user", Password: "secret",
+		Parameters: `{"read_only":true}`}
+	if err = s.CreateBinding(sb); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetBinding(sb.ID); err != nil || got != sb {
+		t.Error("GetBinding: expected ", sb, " got ", got, err)
+	}
+	if bindings, err := s.ListBindings(testID); err != nil || len(bindings) != 1 {
+		t.Error("ListBindings: expected one binding got ", bindings, err)
+	}
+
+	// ports are allocated lowest first and reused once released
+	r := PortRange{Min: 7000, Max: 7001}
+	if port, err := s.AllocatePort(testID, r); err != nil || port != 7000 {
+		t.Error("AllocatePort: expected 7000 got ", port, err)
+	}
+	if port, err := s.AllocatePort(inexistentID, r); err != nil || port != 7001 {
+		t.Error("AllocatePort: expected 7001 got ", port, err)
+	}
+	if _, err := s.AllocatePort(inexistentID, r); err != ErrNoPortAvailable {
+		t.Error("AllocatePort: expected ErrNoPortAvailable got ", err)
+	}
+	if count, err := s.CountPorts(r); err != nil || count != 2 {
+		t.Error("CountPorts: expected 2 got ", count, err)
+	}
+	if count, err := s.CountPorts(PortRange{Min: 7001, Max: 7100}); err != nil || count != 1 {
+		t.Error("CountPorts: expected 1 in 7001-7100 got ", count, err)
+	}
+	if err := s.ReleasePort(7001); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := s.AllocatePort(inexistentID, r); err != nil || port != 7001 {
+		t.Error("AllocatePort: expected released port 7001 got ", port, err)
+	}
+	defer s.ReleasePort(7001)
+
+	first := Operation{ID: "first", InstanceID: testID, Type: OperationProvision, State: OperationInProgress}
+	second := Operation{ID: "second", InstanceID: testID, Type: OperationUpdate, State: OperationInProgress}
+	if err = s.CreateOperation(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateOperation(second); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateOperation(first.ID, OperationSucceeded, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if op, err := s.GetOperation(testID, ""); err != nil || op.ID != second.ID {
+		t.Error("GetOperation: expected latest operation got ", op, err)
+	}
+	if op, err := s.GetOperation(testID, first.ID); err != nil || op.State != OperationSucceeded {
+		t.Error("GetOperation: expected succeeded operation got ", op, err)
+	}
+	if _, err := s.GetOperation(inexistentID, ""); err != ErrOperationNotFound {
+		t.Error("Inexistent operation: expected ErrOperationNotFound got ", err)
+	}
+
+	rule := ForwardRule{InstanceID: testID, Port: 5432, Target: "172.17.0.2:5432"}
+	if err = s.SaveForwardRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	rule.Target = "172.17.0.3:5432"
+	if err = s.SaveForwardRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetForwardRule(testID); err != nil || got != rule {
+		t.Error("GetForwardRule: expected replaced rule ", rule, " got ", got, err)
+	}
+	if rules, err := s.ListForwardRules(); err != nil || len(rules) != 1 {
+		t.Error("ListForwardRules: expected one rule got ", rules, err)
+	}
+
+	// bindings and forward rules are deleted along with their instance
+	if deleted, err := s.DeleteInstance(testID); err != nil || !deleted {
+		t.Error("DeleteInstance: instance not deleted ", err)
+	}
+	if deleted, err := s.DeleteInstance(testID); err != nil || deleted {
+		t.Error("DeleteInstance: inexistent instance deleted ", err)
+	}
+	if port, err := s.AllocatePort(inexistentID, r); err != nil || port != 7000 {
+		t.Error("AllocatePort: expected port 7000 of the deleted instance got ", port, err)
+	}
+	defer s.ReleasePort(7000)
+	if _, err := s.GetBinding(sb.ID); err != ErrBindingNotFound {
+		t.Error("Binding of deleted instance: expected ErrBindingNotFound got ", err)
+	}
+	if deleted, err := s.DeleteBinding(sb.ID); err != nil || deleted {
+		t.Error("DeleteBinding: inexistent binding deleted ", err)
+	}
+	if _, err := s.GetForwardRule(testID); err != ErrForwardRuleNotFound {
+		t.Error("Forward rule of deleted instance: expected ErrForwardRuleNotFound got ", err)
+	}
+}
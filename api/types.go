@@ -16,6 +16,10 @@
 
 package api
 
+import (
+	"encoding/json"
+)
+
 // Define object types for broker API
 
 // CatalogObject - /v2/catalog
@@ -26,16 +30,20 @@ type CatalogObject struct {
 // Service implements the structure defined on CF's Service Broker API,
 // returned in the /v2/catalog endpoint
 type Service struct {
-	Name           string          `json:"name"`
-	ID             string          `json:"id"`
-	Description    string          `json:"description"`
-	Tags           []string        `json:"tags"`
-	Requires       []string        `json:"requires"`
-	Bindable       bool            `json:"bindable"`
-	Metadata       []interface{}   `json:"metadata"`
-	DClient        DashboardClient `json:"dashboard_client"`
-	PlanUpdateable bool            `json:"plan_updateable"`
-	Plans          []Plan          `json:"plans"`
+	Name           string                 `json:"name"`
+	ID             string                 `json:"id"`
+	Description    string                 `json:"description"`
+	Tags           []string               `json:"tags"`
+	Requires       []string               `json:"requires"`
+	Bindable       bool                   `json:"bindable"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	DClient        *DashboardClient       `json:"dashboard_client,omitempty"`
+	PlanUpdateable bool                   `json:"plan_updateable"`
+	// InstancesRetrievable and BindingsRetrievable advertise the fetch
+	// endpoints, which the broker always serves
+	InstancesRetrievable bool   `json:"instances_retrievable"`
+	BindingsRetrievable  bool   `json:"bindings_retrievable"`
+	Plans                []Plan `json:"plans"`
 }
 
 // DashboardClient implements object as defined on CF's Service Broker api
@@ -47,12 +55,23 @@ type DashboardClient struct {
 
 // Plan implements object as defined on CF's Service Broker api
 type Plan struct {
-	ID          string        `json:"id"`
-	Name        string        `json:"name"`
-	Description string        `json:"description"`
-	Metadata    []interface{} `json:"metadata"`
-	Free        bool          `json:"free"`
-	Bindable    bool          `json:"bindable"`
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Free        bool                   `json:"free"`
+	Bindable    bool                   `json:"bindable"`
+	Limits      PlanLimits             `json:"-"`
+}
+
+// PlanLimits holds the resources granted to the instances of a plan, zero
+// values mean no limit. Limits are set on the "backend" settings of plans in
+// catalog files, RequiresApp refuses bindings which are not made for an
+// application, such as service keys
+type PlanLimits struct {
+	StorageMB   int64 `json:"storage_mb"`
+	MemoryMB    int64 `json:"memory_mb"`
+	RequiresApp bool  `json:"requires_app"`
 }
 
 // ProvisionRequest is the Body struct expected from requests
@@ -70,8 +89,53 @@ type ProvisionRequest struct {
 // ProvisionResponse as specified in CF's Service Broker api responds a valid
 // json object, at least "{}
 type ProvisionResponse struct {
-	DashboardURL string   `json:"dashboard_url"`
+	DashboardURL string   `json:"dashboard_url,omitempty"`
 	Database     DataBase `json:"database"`
+	Operation    string   `json:"operation,omitempty"`
+}
+
+// FetchInstanceResponse is returned on
+// GET /v2/service_instances/:instance_id
+// the storage used by the instance is reported along with the quota of its
+// plan, usage is left out when the provisioner cannot measure it
+type FetchInstanceResponse struct {
+	ServiceID     string          `json:"service_id"`
+	PlanID        string          `json:"plan_id"`
+	DashboardURL  string          `json:"dashboard_url,omitempty"`
+	Parameters    json.RawMessage `json:"parameters,omitempty"`
+	QuotaExceeded bool            `json:"quota_exceeded"`
+	UsageBytes    int64           `json:"usage_bytes,omitempty"`
+	QuotaBytes    int64           `json:"quota_bytes,omitempty"`
+}
+
+// UpdateRequest is the Body struct expected from requests
+// PATCH /v2/service_instances/:instance_id
+// service_id*        string
+// plan_id            string
+// parameters         json obj
+// previous_values    object
+// accepts_incomplete boolean
+// required fields marked with [*]
+type UpdateRequest struct {
+	ServiceID         string         `json:"service_id"`
+	PlanID            string         `json:"plan_id"`
+	Parameters        interface{}    `json:"parameters"`
+	PreviousValues    PreviousValues `json:"previous_values"`
+	AcceptsIncomplete bool           `json:"accepts_incomplete"`
+}
+
+// PreviousValues holds the attributes of the instance prior to an update
+type PreviousValues struct {
+	ServiceID string `json:"service_id,omitempty"`
+	PlanID    string `json:"plan_id,omitempty"`
+	OrgID     string `json:"organization_id,omitempty"`
+	SpaceID   string `json:"space_id,omitempty"`
+}
+
+// UpdateResponse as specified in CF's Service Broker api, operation is only
+// included for asynchronous updates
+type UpdateResponse struct {
+	Operation string `json:"operation,omitempty"`
 }
 
 // DeprovisionRequest type specification
@@ -93,21 +157,154 @@ type DeprovisionRequest struct {
 // accepts_incomplete - bolean
 // Response might be just {} for mvp
 type DeprovisionResponse struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Operation string `json:"operation,omitempty"`
+}
+
+// LastOperationResponse type specification, returned when the platform polls
+// GET /v2/service_instances/:instance_id/last_operation
+// state*       string ("in progress", "succeeded" or "failed")
+// description  string
+type LastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// Operation states as defined on CF's Service Broker api
+const (
+	OperationInProgress = "in progress"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+)
+
+// Operation types recorded for asynchronous operations
+const (
+	OperationProvision   = "provision"
+	OperationDeprovision = "deprovision"
+	OperationUpdate      = "update"
+)
+
+// Operation type holds the state of an asynchronous operation executed in
+// background over a service instance
+type Operation struct {
+	ID          string
+	InstanceID  string
+	Type        string
+	State       string
+	Description string
+}
+
+// BindRequest is the Body struct expected from requests
+// PUT /v2/service_instances/:instance_id/service_bindings/:binding_id
+// service_id*    string
+// plan_id*       string
+// app_guid       string (deprecated in favor of bind_resource)
+// bind_resource  object
+// parameters     json obj
+// required fields marked with [*]
+type BindRequest struct {
+	ServiceID    string       `json:"service_id"`
+	PlanID       string       `json:"plan_id"`
+	AppGUID      string       `json:"app_guid"`
+	BindResource BindResource `json:"bind_resource"`
+	Parameters   interface{}  `json:"parameters"`
+}
+
+// BindResource identifies the platform resource the binding is created for
+type BindResource struct {
+	AppGUID string `json:"app_guid,omitempty"`
+	Route   string `json:"route,omitempty"`
+}
+
+// BindResponse as specified in CF's Service Broker api, credentials are
+// exposed to the bound application through VCAP_SERVICES
+type BindResponse struct {
+	Credentials Credentials `json:"credentials"`
+}
+
+// FetchBindingResponse is returned on
+// GET /v2/service_instances/:instance_id/service_bindings/:binding_id
+type FetchBindingResponse struct {
+	Credentials Credentials     `json:"credentials"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// Credentials holds the data required by an application to connect to its
+// PostgreSQL database
+type Credentials struct {
+	URI      string `json:"uri"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+}
+
+// UnbindRequest type specification, values are received as query params
+// service_id*        string
+// plan_id*           string
+// required fields marked with [*]
+type UnbindRequest struct {
+	ServiceID string `json:"service_id"`
+	PlanID    string `json:"plan_id"`
+}
+
+// ServiceBinding type holds the data of a PostgreSQL role created for a
+// binding inside a service instance
+type ServiceBinding struct {
+	ID         string
+	InstanceID string
+	Username   string
+	Password   string
+	// Parameters are the JSON encoded parameters of the bind request
+	Parameters string
+}
+
+// Matches reports whether the bind request asks for the same parameters the
+// binding was created with
+func (sb ServiceBinding) Matches(br BindRequest) bool {
+	parameters, err := encodeParameters(br.Parameters)
+	return err == nil && sb.Parameters == parameters
 }
 
 // ServiceInstance type holds required data in order to provision service with
-// docker engine
+// a Provisioner
 type ServiceInstance struct {
 	ID      string
 	Port    int
 	Info    string
 	Service string
+	PlanID  string
+	// ServiceID, OrganizationGUID and SpaceGUID are the attributes requested
+	// on provision, retried requests must match them
+	ServiceID        string
+	OrganizationGUID string
+	SpaceGUID        string
+	// QuotaExceeded is set while the instance uses more storage than its
+	// plan allows, write privileges of bound roles are revoked meanwhile
+	QuotaExceeded bool
+	// AdminPassword is the generated password of the instance's superuser,
+	// empty for instances provisioned before passwords were generated
+	AdminPassword string
+	// Parameters are the JSON encoded parameters of the provision request
+	Parameters string
+}
+
+// Matches reports whether the provision request asks for the same service,
+// plan, organization, space and parameters the instance was provisioned with
+func (si ServiceInstance) Matches(pr ProvisionRequest) bool {
+	parameters, err := encodeParameters(pr.Parameters)
+	return err == nil &&
+		si.ServiceID == pr.ServiceID &&
+		si.PlanID == pr.PlanID &&
+		si.OrganizationGUID == pr.OrganizationGUID &&
+		si.SpaceGUID == pr.SpaceGUID &&
+		si.Parameters == parameters
 }
 
 // Inspect type is used to consult running service instance on docker engine,
-// allows to retrieve details from docker's cli output
+// allows to retrieve details from docker's engine API responses
 type Inspect struct {
 	List []Container
 }
@@ -124,14 +321,46 @@ type DataBase struct {
 // service on the docker engine(used in conjunction with Inspect struct)
 type NetworkSettings struct {
 	IPAddress string
+	Networks  map[string]EndpointSettings
+}
+
+// EndpointSettings type holds the address of a container on a docker network
+type EndpointSettings struct {
+	IPAddress string
 }
 
 // Container type used in conjunction with Inspect and NetworkSettings type to
-// retrieve data from docker cli
+// retrieve data from docker engine
 type Container struct {
+	ID              string `json:"Id"`
+	Name            string
+	State           ContainerState
 	NetworkSettings NetworkSettings
 }
 
+// ContainerState type reports whether a container is running
+type ContainerState struct {
+	Status  string
+	Running bool
+}
+
+// IPAddress returns the address of the container, newer engines only report
+// it per network
+func (c Container) IPAddress() string {
+	if c.NetworkSettings.IPAddress != "" {
+		return c.NetworkSettings.IPAddress
+	}
+	if n, ok := c.NetworkSettings.Networks["bridge"]; ok {
+		return n.IPAddress
+	}
+	for _, n := range c.NetworkSettings.Networks {
+		if n.IPAddress != "" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
 // Empty type used for marshalling empty jsons on byte slices to return in a
 // response body
 type Empty struct{}
@@ -67,3 +67,41 @@ func IsValidDeprovisionRequest(r DeprovisionRequest) bool {
 	}
 	return valid
 }
+
+// IsValidBindRequest verifies that the body of a bind request includes the
+// obligatory fields as valid UUID values
+func IsValidBindRequest(r BindRequest) bool {
+	switch {
+	case IsValidUUID(r.ServiceID) == false:
+	case IsValidUUID(r.PlanID) == false:
+	default:
+		return true
+	}
+	return false
+}
+
+// IsValidUnbindRequest verifies that the provided request is valid for the
+// DELETE http method on service bindings
+func IsValidUnbindRequest(r UnbindRequest) bool {
+	valid := false
+	switch {
+	case r == UnbindRequest{}: // request must not be empty or have zero value
+	case IsValidUUID(r.ServiceID) == false: // ServiceId must be a valid UUID
+	case IsValidUUID(r.PlanID) == false: // PlanId must also be a valid UUID
+	default:
+		valid = true // Request meets expectations
+	}
+	return valid
+}
+
+// IsValidUpdateRequest verifies that the body of an update request includes
+// a valid service ID and, when a plan change is requested, a valid plan ID
+func IsValidUpdateRequest(r UpdateRequest) bool {
+	switch {
+	case IsValidUUID(r.ServiceID) == false:
+	case r.PlanID != "" && IsValidUUID(r.PlanID) == false:
+	default:
+		return true
+	}
+	return false
+}
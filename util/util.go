@@ -18,11 +18,13 @@ package util
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 )
 
@@ -56,6 +58,18 @@ func CheckSha512(value string, checksum []byte) bool {
 	return bytes.Equal(c, checksum)
 }
 
+// GenerateRandomString reads n cryptographically secure random bytes and
+// returns them hex encoded, the resulting string is 2*n characters long and
+// is safe to use as a password or within SQL identifiers
+func GenerateRandomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // GetCertSignatureAndPublicAlgorithms accepts a certificate's path(string) and
 // returns the algorithm used to sign provided certificate.
 func GetCertSignatureAndPublicAlgorithms(cert tls.Certificate) (x509.SignatureAlgorithm, x509.PublicKeyAlgorithm, error) {
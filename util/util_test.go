@@ -64,3 +64,20 @@ func TestCheckSha512(t *testing.T) {
 		t.Error("Checksum for the same origin value doesn't match")
 	}
 }
+
+func TestGenerateRandomString(t *testing.T) {
+	s1, err := GenerateRandomString(bSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s1) != 2*bSize {
+		t.Error("Random string has unexpected length ", len(s1))
+	}
+	s2, err := GenerateRandomString(bSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 == s2 {
+		t.Error("Two generated random strings are equal")
+	}
+}